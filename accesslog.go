@@ -0,0 +1,214 @@
+package usocksd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+// AccessLogConfig is a set of configurations for the access log.
+//
+// Filename and Syslog are mutually exclusive.  If both are empty,
+// the access log is disabled.
+type AccessLogConfig struct {
+	Filename string
+	Syslog   string
+	Format   string
+}
+
+func (ac *AccessLogConfig) validate() error {
+	if len(ac.Filename) > 0 && len(ac.Syslog) > 0 {
+		return errors.New("access_log: filename and syslog are mutually exclusive")
+	}
+	switch ac.Format {
+	case "", "json", "logfmt", "squid":
+	default:
+		return errors.New("access_log: unknown format: " + ac.Format)
+	}
+	return nil
+}
+
+func (ac *AccessLogConfig) formatter() log.Formatter {
+	switch ac.Format {
+	case "logfmt":
+		return log.Logfmt{}
+	case "squid":
+		return squidFormat{}
+	}
+	return log.JSONFormat{}
+}
+
+// openSyslog connects to the syslog daemon specified by an URL
+// such as "unixgram:///dev/log" or "udp://10.0.0.1:514".
+func openSyslog(s string) (io.WriteCloser, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	var raddr string
+	switch u.Scheme {
+	case "unix", "unixgram":
+		raddr = u.Path
+	case "udp", "tcp":
+		raddr = u.Host
+	default:
+		return nil, errors.New("access_log: unsupported syslog URL: " + s)
+	}
+	return syslog.Dial(u.Scheme, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "usocksd")
+}
+
+// accessLogFile opens the access log file for log.NewReopenWriter,
+// and remembers the last opened file to close it at shutdown.
+type accessLogFile struct {
+	mu     sync.Mutex
+	name   string
+	f      *os.File
+	closed bool
+}
+
+func (a *accessLogFile) Open() (io.WriteCloser, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, os.ErrClosed
+	}
+	f, err := os.OpenFile(a.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a.f = f
+	return f, nil
+}
+
+func (a *accessLogFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	if a.f == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+// NewAccessLogger creates a logger for the access log.
+// It returns nil if the access log is disabled.
+//
+// The access log file is reopened on SIGUSR1 like the main log for
+// log rotation.  The returned io.Closer should be closed at shutdown.
+func NewAccessLogger(c *Config) (*log.Logger, io.Closer, error) {
+	ac := c.AccessLog
+
+	var w io.Writer
+	var closer io.Closer
+	switch {
+	case len(ac.Filename) > 0:
+		f := &accessLogFile{name: ac.Filename}
+		rw, err := log.NewReopenWriter(f, syscall.SIGUSR1)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closer = rw, f
+	case len(ac.Syslog) > 0:
+		sw, err := openSyslog(ac.Syslog)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closer = sw, sw
+	default:
+		return nil, nil, nil
+	}
+
+	logger := log.NewLogger()
+	logger.SetTopic("usocksd-access")
+	logger.SetFormatter(ac.formatter())
+	logger.SetOutput(w)
+	return logger, closer, nil
+}
+
+// squidFormat formats access logs like the native log format of Squid.
+//
+//	time elapsed client code/status bytes method URL user hierarchy/peer type
+type squidFormat struct{}
+
+func (f squidFormat) String() string {
+	return "squid"
+}
+
+func squidCode(result string) string {
+	switch result {
+	case socks.ResultSuccess:
+		return "TCP_TUNNEL/200"
+	case socks.ResultError:
+		return "TCP_TUNNEL_ABORTED/200"
+	case socks.ResultDenied:
+		return "TCP_DENIED/403"
+	case socks.ResultAuthFailed:
+		return "TCP_DENIED/407"
+	case socks.ResultDialFailed:
+		return "TCP_MISS/503"
+	}
+	return "TAG_NONE/400"
+}
+
+func stringField(fields map[string]interface{}, key string) string {
+	if v, ok := fields[key].(string); ok && len(v) > 0 {
+		return v
+	}
+	return "-"
+}
+
+func (f squidFormat) Format(buf []byte, l *log.Logger, t time.Time, severity int,
+	msg string, fields map[string]interface{}) ([]byte, error) {
+
+	max := cap(buf)
+
+	var elapsed float64
+	if v, ok := fields["elapsed"].(float64); ok {
+		elapsed = v
+	}
+	client := stringField(fields, "client_addr")
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	var rx int64
+	if v, ok := fields["rx_bytes"].(int64); ok {
+		rx = v
+	}
+	url := stringField(fields, "dest_host")
+	if port, ok := fields["dest_port"].(int); ok {
+		url = net.JoinHostPort(url, strconv.Itoa(port))
+	}
+	hier := "HIER_NONE/-"
+	if addr, ok := fields["dest_addr"].(string); ok {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			hier = "HIER_DIRECT/" + host
+		}
+	}
+	result, _ := fields["result"].(string)
+
+	buf = fmt.Appendf(buf, "%d.%03d %6d %s %s %d CONNECT %s %s %s -\n",
+		t.Unix(), t.Nanosecond()/int(time.Millisecond),
+		int64(elapsed*1000),
+		client,
+		squidCode(result),
+		rx,
+		url,
+		stringField(fields, "user"),
+		hier,
+	)
+	if len(buf) > max {
+		return nil, log.ErrTooLarge
+	}
+	return buf, nil
+}
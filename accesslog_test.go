@@ -0,0 +1,123 @@
+package usocksd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+func TestSquidFormat(t *testing.T) {
+	t.Parallel()
+
+	fields := map[string]interface{}{
+		"client_addr": "10.1.2.3:54321",
+		"result":      socks.ResultSuccess,
+		"elapsed":     1.5,
+		"tx_bytes":    int64(100),
+		"rx_bytes":    int64(2000),
+		"dest_host":   "www.example.com",
+		"dest_port":   443,
+		"dest_addr":   "93.184.216.34:443",
+		"user":        "alice",
+	}
+	ts := time.Unix(1286536308, 779*int64(time.Millisecond))
+	buf := make([]byte, 0, 4096)
+	b, err := squidFormat{}.Format(buf, log.NewLogger(), ts, log.LvInfo, "access", fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "1286536308.779   1500 10.1.2.3 TCP_TUNNEL/200 2000 CONNECT www.example.com:443 alice HIER_DIRECT/93.184.216.34 -\n"
+	if string(b) != expected {
+		t.Errorf("unexpected squid log:\n%q\n%q", string(b), expected)
+	}
+
+	fields = map[string]interface{}{
+		"client_addr": "10.1.2.3:54321",
+		"result":      socks.ResultDenied,
+		"elapsed":     0.001,
+		"rx_bytes":    int64(0),
+		"dest_host":   "bad.example.com",
+		"dest_port":   80,
+	}
+	b, err = squidFormat{}.Format(buf, log.NewLogger(), ts, log.LvInfo, "access", fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "1286536308.779      1 10.1.2.3 TCP_DENIED/403 0 CONNECT bad.example.com:80 - HIER_NONE/- -\n"
+	if string(b) != expected {
+		t.Errorf("unexpected squid log:\n%q\n%q", string(b), expected)
+	}
+}
+
+func TestAccessLogConfig(t *testing.T) {
+	t.Parallel()
+
+	ac := AccessLogConfig{Filename: "/tmp/access.log", Syslog: "udp://127.0.0.1:514"}
+	if ac.validate() == nil {
+		t.Error("filename and syslog should be exclusive")
+	}
+	ac = AccessLogConfig{Format: "apache"}
+	if ac.validate() == nil {
+		t.Error("unknown format should be rejected")
+	}
+	ac = AccessLogConfig{Syslog: "http://127.0.0.1"}
+	if _, _, err := NewAccessLogger(&Config{AccessLog: ac}); err == nil {
+		t.Error("unsupported syslog URL should be rejected")
+	}
+	if l, _, err := NewAccessLogger(NewConfig()); err != nil || l != nil {
+		t.Error("access log should be disabled by default")
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "access.log")
+	l, closer, err := NewAccessLogger(&Config{AccessLog: AccessLogConfig{Filename: name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Info("first", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate the file like logrotate.
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(name); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := l.Info("second", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := os.ReadFile(name + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rotated), "first") || strings.Contains(string(rotated), "second") {
+		t.Errorf("unexpected rotated log: %s", rotated)
+	}
+	if !strings.Contains(string(current), "second") {
+		t.Errorf("unexpected current log: %s", current)
+	}
+}
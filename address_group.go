@@ -1,51 +1,175 @@
 package usocksd
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/cybozu-go/log"
+	"github.com/cybozu-go/well"
 )
 
 const (
-	// invalidCheckInterval is the interval between checking DNSBL for
-	// black-listed IP addresses.
-	invalidCheckInterval = 15 * time.Second
+	// defaultCheckInterval is the default interval between checking
+	// DNSBL for black-listed IP addresses.
+	defaultCheckInterval = 15 * time.Second
+
+	// defaultCheckTimeout is the default timeout of a DNSBL lookup.
+	defaultCheckTimeout = 5 * time.Second
 )
 
+// addressDNSBLCodes are return codes of dnsbl_domain and dnsbl_domain6
+// that mean listed.  127.0.0.1 and 127.255.255.0/24 are excluded as they
+// are test or error codes such as "query refused" of Spamhaus.
+var addressDNSBLCodes = [][2]net.IP{
+	{net.IPv4(127, 0, 0, 2).To4(), net.IPv4(127, 255, 254, 255).To4()},
+}
+
 // AddressGroup is a group of external IP addresses to be used
-// for outgoing connections.  With the help of associated goroutines,
-// IP addresses listed on DNSBL will be checked and excluded.
+// for outgoing connections.  While Run is running, IP addresses
+// listed on DNSBL will be checked and excluded.
+//
+// Fields must not be modified once Run is started.
+//
+// IPv4 and IPv6 addresses are kept in separate pools so that
+// the source address has the same family as the destination.
+//
+// Addresses are picked by weighted rendezvous hashing.  When an
+// address is excluded or restored, only the clients using that
+// address are moved to other addresses.
 type AddressGroup struct {
-	addresses   []net.IP // immutable
-	dnsblDomain string
+	// CheckInterval is the interval between DNSBL checks.
+	// If zero, 15 seconds is used.
+	CheckInterval time.Duration
+
+	// CheckTimeout is the timeout of each DNSBL lookup.
+	// If zero, 5 seconds is used.
+	CheckTimeout time.Duration
+
+	addresses    []net.IP // immutable
+	dnsblDomain  string
+	dnsblDomain6 string
+
+	// lookupHost is net.DefaultResolver.LookupHost unless replaced by tests.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	// probeSocket, probeIfaces and probeControl make probe
+	// connections take the same route as connections to destinations.
+	probeSocket  *SocketConfig
+	probeIfaces  []string
+	probeControl controlFn
 
 	lock     *sync.Mutex
-	valids   []net.IP
+	weights  map[string]float64
+	probe    *ProbeConfig
+	health   map[string]*addressHealth
+	valids4  []net.IP
+	valids6  []net.IP
 	invalids []net.IP
 }
 
+// makeDNSBLDomain returns the DNSBL query name for ip.
+// IPv6 addresses are encoded in reversed nibbles as described in RFC 5782.
 func makeDNSBLDomain(domain string, ip net.IP) string {
 	if len(domain) == 0 {
 		return ""
 	}
-	ip = ip.To4()
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], domain)
+	}
+	ip = ip.To16()
 	if ip == nil {
 		return ""
 	}
-	return fmt.Sprintf("%d.%d.%d.%d.%s", ip[3], ip[2], ip[1], ip[0], domain)
+
+	const hexDigits = "0123456789abcdef"
+	b := make([]byte, 0, 64+len(domain))
+	for i := len(ip) - 1; i >= 0; i-- {
+		b = append(b, hexDigits[ip[i]&0xf], '.', hexDigits[ip[i]>>4], '.')
+	}
+	return string(append(b, domain...))
+}
+
+// dnsblDomainFor returns the DNSBL zone for the family of ip.
+func (a *AddressGroup) dnsblDomainFor(ip net.IP) string {
+	if ip.To4() != nil {
+		return a.dnsblDomain
+	}
+	return a.dnsblDomain6
 }
 
 // isBadIP returns true if IP is registered on DNSBL.
-func (a *AddressGroup) isBadIP(ip net.IP) bool {
-	d := makeDNSBLDomain(a.dnsblDomain, ip)
+// Return codes are interpreted by addressDNSBLCodes.
+func (a *AddressGroup) isBadIP(ctx context.Context, ip net.IP) (bool, error) {
+	zone := a.dnsblDomainFor(ip)
+	d := makeDNSBLDomain(zone, ip)
 	if len(d) == 0 {
-		return false
+		return false, nil
+	}
+	lookupHost := a.lookupHost
+	if lookupHost == nil {
+		lookupHost = net.DefaultResolver.LookupHost
+	}
+	hosts, err := lookupHost(ctx, d)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	addrs := make([]net.IP, 0, len(hosts))
+	for _, h := range hosts {
+		if addr := net.ParseIP(h); addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	zc := DNSBLZoneConfig{Zone: zone, codes: addressDNSBLCodes}
+	return zc.listedBy(addrs) != nil, nil
+}
+
+// splitFamily splits ips into IPv4 and IPv6 addresses.
+func splitFamily(ips []net.IP) (v4, v6 []net.IP) {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	return
+}
+
+// validsOf returns valid addresses of a family.
+// If too few addresses are valid, all addresses are returned.
+func validsOf(addresses, invalids []net.IP) []net.IP {
+	var valids []net.IP
+	for _, ip := range addresses {
+		if !containsIP(invalids, ip) {
+			valids = append(valids, ip)
+		}
+	}
+	if len(valids) < len(addresses)-len(valids) {
+		// Too few valid IPs
+		return addresses
 	}
-	_, err := net.LookupIP(d)
-	return err == nil
+	return valids
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func toStringList(ips []net.IP) []string {
@@ -56,54 +180,268 @@ func toStringList(ips []net.IP) []string {
 	return sips
 }
 
-// detectInvalid is a non-returning method, thus should be
-// called as a goroutine, to detect black-listed IP addresses.
-func (a *AddressGroup) detectInvalid() {
+// Run checks addresses on DNSBL and probes their health periodically
+// until ctx is canceled.
+func (a *AddressGroup) Run(ctx context.Context) error {
+	a.lock.Lock()
+	pc := a.probe
+	a.lock.Unlock()
+
+	var wg sync.WaitGroup
+	if pc != nil && len(pc.Targets) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.probeLoop(ctx)
+		}()
+	}
+
+	interval := a.CheckInterval
+	if interval == 0 {
+		interval = defaultCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		var valids, invalids []net.IP
-		for _, ip := range a.addresses {
-			if a.isBadIP(ip) {
-				invalids = append(invalids, ip)
-			} else {
-				valids = append(valids, ip)
-			}
+		a.detectInvalid(ctx)
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return nil
+		case <-ticker.C:
 		}
-		a.lock.Lock()
-		if len(invalids) > 0 && len(a.invalids) != len(invalids) {
-			_ = log.Warn("detect black-listed IP", map[string]interface{}{
-				"_bad_ips": toStringList(invalids),
+	}
+}
+
+// detectInvalid checks addresses on DNSBL concurrently to detect
+// black-listed IP addresses.  If a check fails, the previous result
+// for the address is kept.
+func (a *AddressGroup) detectInvalid(ctx context.Context) {
+	if len(a.dnsblDomain) == 0 && len(a.dnsblDomain6) == 0 {
+		return
+	}
+
+	timeout := a.CheckTimeout
+	if timeout == 0 {
+		timeout = defaultCheckTimeout
+	}
+
+	type result struct {
+		bad bool
+		err error
+	}
+	results := make([]result, len(a.addresses))
+	var wg sync.WaitGroup
+	for i, ip := range a.addresses {
+		wg.Add(1)
+		go func(i int, ip net.IP) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			bad, err := a.isBadIP(ctx, ip)
+			results[i] = result{bad, err}
+		}(i, ip)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var invalids, listed, delisted []net.IP
+	for i, ip := range a.addresses {
+		bad := results[i].bad
+		if err := results[i].err; err != nil {
+			addressCheckErrorsCounter.WithLabelValues(ip.String()).Inc()
+			_ = log.Warn("failed to check DNSBL", map[string]interface{}{
+				"address":   ip.String(),
+				log.FnError: err.Error(),
 			})
+			bad = containsIP(a.invalids, ip)
+		}
+		wasBad := containsIP(a.invalids, ip)
+		switch {
+		case bad && !wasBad:
+			listed = append(listed, ip)
+		case !bad && wasBad:
+			delisted = append(delisted, ip)
+		}
+		if bad {
+			invalids = append(invalids, ip)
+		}
+	}
+
+	if len(listed) > 0 {
+		_ = log.Warn("detect black-listed IP", map[string]interface{}{
+			"_bad_ips": toStringList(listed),
+		})
+	}
+	if len(delisted) > 0 {
+		_ = log.Info("black-listed IP is delisted", map[string]interface{}{
+			"_ips": toStringList(delisted),
+		})
+	}
+
+	v4, v6 := splitFamily(a.addresses)
+	a.valids4 = validsOf(v4, invalids)
+	a.valids6 = validsOf(v6, invalids)
+	a.invalids = invalids
+	a.updateGauges()
+}
+
+// updateGauges updates per-address gauges.
+// a.lock must be held.
+func (a *AddressGroup) updateGauges() {
+	for _, ip := range a.addresses {
+		listed, valid := 0.0, 0.0
+		if containsIP(a.invalids, ip) {
+			listed = 1
 		}
-		if len(valids) < len(invalids) {
-			// Too few valid IPs
-			valids = a.addresses
+		if containsIP(a.valids4, ip) || containsIP(a.valids6, ip) {
+			valid = 1
 		}
-		a.valids = valids
-		a.invalids = invalids
-		a.lock.Unlock()
-		time.Sleep(invalidCheckInterval)
+		addressListedGauge.WithLabelValues(ip.String()).Set(listed)
+		addressValidGauge.WithLabelValues(ip.String()).Set(valid)
 	}
 }
 
-// PickAddress returns a local IP address for outgoing connection.
+// Check returns an error if all addresses are black-listed.
+func (a *AddressGroup) Check(ctx context.Context) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.invalids) == len(a.addresses) {
+		return errors.New("no valid outgoing address")
+	}
+	return nil
+}
+
+// PickAddress returns a local IPv4 address for outgoing connection.
+// If there is no IPv4 address, nil is returned.
 // hint should be an integer calculated from client and/or target IP addresses.
+//
+// Use PickAddressFor to connect to IPv6 destinations.
 func (a *AddressGroup) PickAddress(hint uint32) net.IP {
+	return a.PickAddressFor(hint, net.IPv4zero)
+}
+
+// PickAddressFor returns a local IP address for outgoing connection
+// to dest.  The address has the same family as dest.  If there is
+// no such address, nil is returned.
+// hint should be an integer calculated from client and/or target IP addresses.
+func (a *AddressGroup) PickAddressFor(hint uint32, dest net.IP) net.IP {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	valids := a.valids6
+	if dest.To4() != nil {
+		valids = a.valids4
+	}
+	if len(valids) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	pick := func(skipQuarantined bool) net.IP {
+		var picked net.IP
+		best := math.Inf(-1)
+		for _, ip := range valids {
+			if skipQuarantined && a.quarantined(ip, now) {
+				continue
+			}
+			w, ok := a.weights[ip.String()]
+			if !ok {
+				w = 1
+			}
+			if score := rendezvousScore(hint, ip, w); score > best {
+				best = score
+				picked = ip
+			}
+		}
+		return picked
+	}
+
+	if ip := pick(true); ip != nil {
+		return ip
+	}
+	// all addresses are quarantined.
+	return pick(false)
+}
+
+// SetWeight sets the weight of ip.  The default weight is 1.
+// Addresses are picked in proportion to their weights.
+func (a *AddressGroup) SetWeight(ip net.IP, weight float64) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	return a.valids[int(hint)%len(a.valids)]
+	if a.weights == nil {
+		a.weights = make(map[string]float64)
+	}
+	a.weights[ip.String()] = weight
 }
 
-// NewAddressGroup initializes a new AddressGroup and starts
-// helper goroutines.
+// rendezvousScore returns the weighted rendezvous hashing score
+// of ip for hint.  The address with the highest score is picked.
+func rendezvousScore(hint uint32, ip net.IP, weight float64) float64 {
+	if weight <= 0 {
+		return math.Inf(-1)
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], hint)
+	h := fnv.New64a()
+	h.Write(b[:])
+	h.Write(ip.To16())
+
+	// finalize the hash as in MurmurHash3 to spread similar inputs.
+	v := h.Sum64()
+	v ^= v >> 33
+	v *= 0xff51afd7ed558ccd
+	v ^= v >> 33
+	v *= 0xc4ceb9fe1a85ec53
+	v ^= v >> 33
+
+	// map the hash to (0, 1).
+	x := (float64(v>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(x)
+}
+
+// NewAddressGroup initializes a new AddressGroup and starts checking
+// the addresses on DNSBL in the global environment of well.
+// dnsblDomain is the DNSBL zone for IPv4 addresses.
 func NewAddressGroup(addresses []net.IP, dnsblDomain string) *AddressGroup {
+	a := NewAddressGroupDual(addresses, dnsblDomain, "")
+	well.Go(a.Run)
+	return a
+}
+
+// NewAddressGroupContext initializes a new AddressGroup and starts
+// checking the addresses until ctx is canceled.
+// dnsblDomain and dnsblDomain6 are DNSBL zones for IPv4 and IPv6
+// addresses, respectively.
+func NewAddressGroupContext(ctx context.Context, addresses []net.IP, dnsblDomain, dnsblDomain6 string) *AddressGroup {
+	a := NewAddressGroupDual(addresses, dnsblDomain, dnsblDomain6)
+	go a.Run(ctx)
+	return a
+}
+
+// NewAddressGroupDual initializes a new AddressGroup.
+// dnsblDomain and dnsblDomain6 are DNSBL zones for IPv4 and IPv6
+// addresses, respectively.  Call Run to check the addresses.
+func NewAddressGroupDual(addresses []net.IP, dnsblDomain, dnsblDomain6 string) *AddressGroup {
+	v4, v6 := splitFamily(addresses)
 	a := &AddressGroup{
-		addresses:   addresses,
-		dnsblDomain: dnsblDomain,
-		lock:        new(sync.Mutex),
-		valids:      addresses,
-		invalids:    nil,
+		addresses:    addresses,
+		dnsblDomain:  dnsblDomain,
+		dnsblDomain6: dnsblDomain6,
+		lock:         new(sync.Mutex),
+		valids4:      v4,
+		valids6:      v6,
+		invalids:     nil,
 	}
-	go a.detectInvalid()
+	a.lock.Lock()
+	a.updateGauges()
+	a.lock.Unlock()
 	return a
 }
@@ -1,10 +1,12 @@
 package usocksd
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestMakeDNSBLDomain(t *testing.T) {
@@ -14,6 +16,17 @@ func TestMakeDNSBLDomain(t *testing.T) {
 	if d != "78.56.34.12.zen.spamhaus.org" {
 		t.Error(d + ` != "78.56.34.12.zen.spamhaus.org"`)
 	}
+
+	d = makeDNSBLDomain("zen.spamhaus.org", net.ParseIP("2001:db8:1:2:3:4:567:89ab"))
+	expected := "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.zen.spamhaus.org"
+	if d != expected {
+		t.Error(d + " != " + expected)
+	}
+
+	d = makeDNSBLDomain("zen.spamhaus.org", net.ParseIP("::ffff:12.34.56.78"))
+	if d != "78.56.34.12.zen.spamhaus.org" {
+		t.Error(d + ` != "78.56.34.12.zen.spamhaus.org"`)
+	}
 }
 
 func TestIsBadIP(t *testing.T) {
@@ -22,13 +35,33 @@ func TestIsBadIP(t *testing.T) {
 	a := &AddressGroup{dnsblDomain: "zen.spamhaus.org"}
 
 	// unstable test
-	if false && !a.isBadIP(net.ParseIP("211.128.234.229")) {
+	if bad, _ := a.isBadIP(context.Background(), net.ParseIP("211.128.234.229")); false && !bad {
 		t.Error("211.128.234.229 should be black-listed")
 	}
 
-	if a.isBadIP(net.ParseIP("10.0.0.1")) {
+	if bad, _ := a.isBadIP(context.Background(), net.ParseIP("10.0.0.1")); bad {
 		t.Error("10.0.0.1 should not be black-listed")
 	}
+
+	// error codes of DNSBL must not be taken as listed.
+	a.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "1.0.0.10.zen.spamhaus.org":
+			return []string{"127.0.0.2"}, nil
+		case "2.0.0.10.zen.spamhaus.org":
+			return []string{"127.255.255.254"}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if bad, err := a.isBadIP(context.Background(), net.ParseIP("10.0.0.1")); err != nil || !bad {
+		t.Error("10.0.0.1 should be black-listed:", err)
+	}
+	if bad, err := a.isBadIP(context.Background(), net.ParseIP("10.0.0.2")); err != nil || bad {
+		t.Error("an error code should not be taken as listed:", err)
+	}
+	if bad, err := a.isBadIP(context.Background(), net.ParseIP("10.0.0.3")); err != nil || bad {
+		t.Error("10.0.0.3 should not be black-listed:", err)
+	}
 }
 
 func TestPick(t *testing.T) {
@@ -36,9 +69,11 @@ func TestPick(t *testing.T) {
 
 	ip1 := net.ParseIP("12.34.56.78")
 	ip2 := net.ParseIP("10.0.0.1")
+	ip3 := net.ParseIP("2001:db8::1")
 	a := &AddressGroup{
-		lock:   new(sync.Mutex),
-		valids: []net.IP{ip1, ip2},
+		lock:    new(sync.Mutex),
+		valids4: []net.IP{ip1, ip2},
+		valids6: []net.IP{ip3},
 	}
 
 	validate := func(ip net.IP) error {
@@ -57,4 +92,200 @@ func TestPick(t *testing.T) {
 	if err := validate(a.PickAddress(2)); err != nil {
 		t.Error(err)
 	}
+
+	dest4 := net.ParseIP("192.0.2.1")
+	for hint := uint32(0); hint < 3; hint++ {
+		if ip := a.PickAddressFor(hint, dest4); !ip.Equal(a.PickAddress(hint)) {
+			t.Errorf("IPv4 destination should use IPv4 source: %v", ip)
+		}
+	}
+
+	dest6 := net.ParseIP("2001:db8:1::1")
+	for hint := uint32(0); hint < 3; hint++ {
+		if ip := a.PickAddressFor(hint, dest6); !ip.Equal(ip3) {
+			t.Errorf("IPv6 destination should use IPv6 source: %v", ip)
+		}
+	}
+
+	a.valids6 = nil
+	if ip := a.PickAddressFor(0, dest6); ip != nil {
+		t.Errorf("no source address should be picked: %v", ip)
+	}
+}
+
+func TestValidsOf(t *testing.T) {
+	t.Parallel()
+
+	ip1 := net.ParseIP("2001:db8::1")
+	ip2 := net.ParseIP("2001:db8::2")
+	ip3 := net.ParseIP("2001:db8::3")
+	all := []net.IP{ip1, ip2, ip3}
+
+	valids := validsOf(all, []net.IP{ip2, net.ParseIP("192.0.2.1")})
+	if len(valids) != 2 || !valids[0].Equal(ip1) || !valids[1].Equal(ip3) {
+		t.Errorf("unexpected valids: %v", valids)
+	}
+
+	valids = validsOf(all, []net.IP{ip1, ip2})
+	if len(valids) != 3 {
+		t.Errorf("all addresses should be used if too few are valid: %v", valids)
+	}
+}
+
+func TestRendezvous(t *testing.T) {
+	t.Parallel()
+
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("192.0.2.3"),
+		net.ParseIP("192.0.2.4"),
+	}
+	a := &AddressGroup{lock: new(sync.Mutex), valids4: ips}
+	dest := net.ParseIP("198.51.100.1")
+
+	const clients = 20000
+	before := make([]net.IP, clients)
+	counts := make(map[string]int)
+	for i := range before {
+		before[i] = a.PickAddressFor(uint32(i)*2654435761, dest)
+		counts[before[i].String()]++
+	}
+	for _, ip := range ips {
+		share := float64(counts[ip.String()]) / clients
+		if share < 0.22 || share > 0.28 {
+			t.Errorf("%s: unbalanced share %f", ip, share)
+		}
+	}
+
+	// exclude one address.  Only its clients should move.
+	a.valids4 = []net.IP{ips[0], ips[1], ips[3]}
+	moved := 0
+	for i := range before {
+		ip := a.PickAddressFor(uint32(i)*2654435761, dest)
+		if ip.Equal(before[i]) {
+			continue
+		}
+		moved++
+		if !before[i].Equal(ips[2]) {
+			t.Fatalf("client %d moved from %s to %s", i, before[i], ip)
+		}
+	}
+	if fraction := float64(moved) / clients; fraction < 0.22 || fraction > 0.28 {
+		t.Errorf("unexpected remapping fraction %f", fraction)
+	}
+
+	// restore the address.  The clients should return.
+	a.valids4 = ips
+	for i := range before {
+		if ip := a.PickAddressFor(uint32(i)*2654435761, dest); !ip.Equal(before[i]) {
+			t.Fatalf("client %d did not return to %s: %s", i, before[i], ip)
+		}
+	}
+
+	// weights
+	a.SetWeight(ips[0], 3)
+	moved = 0
+	counts = make(map[string]int)
+	for i := range before {
+		ip := a.PickAddressFor(uint32(i)*2654435761, dest)
+		counts[ip.String()]++
+		if ip.Equal(before[i]) {
+			continue
+		}
+		moved++
+		if !ip.Equal(ips[0]) {
+			t.Fatalf("client %d moved from %s to %s", i, before[i], ip)
+		}
+	}
+	if share := float64(counts[ips[0].String()]) / clients; share < 0.47 || share > 0.53 {
+		t.Errorf("unexpected share of weighted address: %f", share)
+	}
+	if fraction := float64(moved) / clients; fraction < 0.22 || fraction > 0.28 {
+		t.Errorf("unexpected remapping fraction by weight %f", fraction)
+	}
+}
+
+func TestAddressGroupRun(t *testing.T) {
+	t.Parallel()
+
+	ip1 := net.ParseIP("192.0.2.1")
+	ip2 := net.ParseIP("192.0.2.2")
+	ip3 := net.ParseIP("192.0.2.3")
+	a := NewAddressGroupDual([]net.IP{ip1, ip2, ip3}, "bl.example.com", "")
+	a.CheckInterval = 10 * time.Millisecond
+	a.CheckTimeout = 50 * time.Millisecond
+
+	var mu sync.Mutex
+	listed := map[string]bool{"1.2.0.192.bl.example.com": true}
+	errs := 0
+	a.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case listed[host]:
+			return []string{"127.0.0.2"}, nil
+		case host == "3.2.0.192.bl.example.com" && errs > 0:
+			errs--
+			// hangs until timeout
+			mu.Unlock()
+			<-ctx.Done()
+			mu.Lock()
+			return nil, ctx.Err()
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = a.Run(ctx)
+		close(done)
+	}()
+
+	waitInvalids := func(expected ...net.IP) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			a.lock.Lock()
+			invalids := a.invalids
+			a.lock.Unlock()
+			if len(invalids) == len(expected) {
+				ok := true
+				for _, ip := range expected {
+					ok = ok && containsIP(invalids, ip)
+				}
+				if ok {
+					return
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("invalids did not become %v", expected)
+	}
+	waitInvalids(ip1)
+
+	// a failed check keeps the previous result.
+	mu.Lock()
+	listed["3.2.0.192.bl.example.com"] = true
+	mu.Unlock()
+	waitInvalids(ip1, ip3)
+	mu.Lock()
+	delete(listed, "3.2.0.192.bl.example.com")
+	errs = 3
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	a.lock.Lock()
+	if !containsIP(a.invalids, ip3) {
+		t.Error("192.0.2.3 should be kept listed while checks fail")
+	}
+	a.lock.Unlock()
+	waitInvalids(ip1)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop")
+	}
 }
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/cybozu-go/log"
 	"github.com/cybozu-go/usocksd"
+	"github.com/cybozu-go/usocksd/metrics"
 	"github.com/cybozu-go/well"
 )
 
@@ -16,11 +22,59 @@ const (
 )
 
 var (
-	optFile = flag.String("f", "", "configuration file name")
+	optFile     = flag.String("f", "", "configuration file name")
+	optTestRule = flag.String("test-rule", "", "test access rules for HOST:PORT and exit")
+	optTestTime = flag.String("test-time", "", "time in RFC3339 for -test-rule (default now)")
 )
 
-func serveMetrics(c *usocksd.Config) error {
-	metricsServer := usocksd.NewMetricsServer(c)
+// testRule prints how rules in c apply to a request for dest.
+func testRule(c *usocksd.Config, dest string) error {
+	host, p, err := net.SplitHostPort(dest)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return fmt.Errorf("invalid port: %s", p)
+	}
+	now := time.Now()
+	if len(*optTestTime) > 0 {
+		now, err = time.Parse(time.RFC3339, *optTestTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := usocksd.FetchFeeds(context.Background(), c); err != nil {
+		return err
+	}
+	d := c.Decide(host, port, now)
+	if d.Allowed {
+		fmt.Println("result: allowed")
+	} else {
+		fmt.Println("result: denied")
+		fmt.Println("deny_reason:", d.DenyReason)
+	}
+	if len(d.Rule) > 0 {
+		fmt.Println("rule:", d.Rule)
+	}
+	if len(d.Schedule) > 0 {
+		fmt.Println("schedule:", d.Schedule)
+	}
+	for _, ip := range d.IPs {
+		fmt.Println("dest_ip:", ip)
+	}
+	if len(d.Country) > 0 {
+		fmt.Println("dest_country:", d.Country)
+	}
+	if d.ASN != 0 {
+		fmt.Println("dest_asn:", d.ASN)
+	}
+	fmt.Println("time:", now.Format(time.RFC3339))
+	return nil
+}
+
+func serveMetrics(c *usocksd.Config, metricsServer *metrics.Server) error {
 	mln, err := usocksd.MetricsListener(c)
 	if err != nil {
 		return fmt.Errorf("could not initialize metrics server: %w", err)
@@ -28,15 +82,74 @@ func serveMetrics(c *usocksd.Config) error {
 	return metricsServer.Serve(mln)
 }
 
+// drainOnSignal makes the readiness check fail as soon as a stop
+// signal is received.  well cancels the environment after a delay,
+// so load balancers can stop sending traffic before listeners close.
+func drainOnSignal(metricsServer *metrics.Server) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-ch
+		_ = log.Info("start draining", map[string]interface{}{
+			"signal": s.String(),
+		})
+		metricsServer.Drain()
+	}()
+}
+
 func serve(lns []net.Listener, c *usocksd.Config) {
-	socksServer := usocksd.NewServer(c)
-	for _, ln := range lns {
+	shutdownTracing, err := usocksd.SetupTracing(context.Background(), c)
+	if err != nil {
+		log.ErrorExit(err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			_ = log.Error("failed to flush traces", map[string]interface{}{
+				log.FnError: err.Error(),
+			})
+		}
+	}()
+
+	// listeners restored by well.Graceful are not wrapped by Listeners.
+	lns = usocksd.TrackListeners(usocksd.SocketListeners(c, lns))
+	socksServer, err := usocksd.NewServer(c)
+	if err != nil {
+		log.ErrorExit(err)
+	}
+	accessLog, accessLogCloser, err := usocksd.NewAccessLogger(c)
+	if err != nil {
+		log.ErrorExit(err)
+	}
+	if accessLogCloser != nil {
+		defer accessLogCloser.Close()
+	}
+	socksServer.AccessLog = accessLog
+	socksLns, transparentLns := usocksd.SplitListeners(c, lns)
+	for _, ln := range socksLns {
 		socksServer.Serve(ln)
 	}
-	if err := serveMetrics(c); err != nil {
+	for _, ln := range transparentLns {
+		socksServer.ServeTransparent(ln, usocksd.OriginalDestination(c))
+	}
+	well.Go(func(ctx context.Context) error {
+		return usocksd.WatchSites(ctx, c)
+	})
+	well.Go(func(ctx context.Context) error {
+		return usocksd.WatchGeoIP(ctx, c)
+	})
+	well.Go(func(ctx context.Context) error {
+		return usocksd.WatchFeeds(ctx, c)
+	})
+	well.Go(func(ctx context.Context) error {
+		return usocksd.WatchAddresses(ctx, socksServer)
+	})
+	metricsServer := usocksd.NewMetricsServer(c, socksServer, lns)
+	drainOnSignal(metricsServer)
+	if err := serveMetrics(c, metricsServer); err != nil {
 		log.ErrorExit(err)
 	}
 	if err := well.Wait(); err != nil && !well.IsSignaled(err) {
+		_ = shutdownTracing(context.Background())
 		log.ErrorExit(err)
 	}
 }
@@ -57,6 +170,13 @@ func main() {
 			}
 		}
 	}
+	if len(*optTestRule) > 0 {
+		if err := testRule(c, *optTestRule); err != nil {
+			log.ErrorExit(err)
+		}
+		return
+	}
+
 	err := c.Log.Apply()
 	if err != nil {
 		log.ErrorExit(err)
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/cybozu-go/well"
@@ -16,28 +18,92 @@ const (
 
 // IncomingConfig is a set of configurations to accept clients.
 type IncomingConfig struct {
-	Port         int
-	MetricsPort  int `toml:"metrics_port"`
-	Addresses    []net.IP
-	AllowFrom    []string `toml:"allow_from"`
-	allowSubnets []*net.IPNet
+	Port               int
+	MetricsPort        int `toml:"metrics_port"`
+	Addresses          []net.IP
+	AllowFrom          []string     `toml:"allow_from"`
+	NegotiationTimeout Duration     `toml:"negotiation_timeout"`
+	RelayBufferSize    int          `toml:"relay_buffer_size"`
+	Socket             SocketConfig `toml:"socket"`
+	allowSubnets       []*net.IPNet
+}
+
+// Duration is time.Duration decoded from a string such as "10m".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
 }
 
 // OutgoingConfig is a set of configurations to connect to destinations.
 type OutgoingConfig struct {
-	AllowSites  []string `toml:"allow_sites"`
-	DenySites   []string `toml:"deny_sites"`
-	DenyPorts   []int    `toml:"deny_ports"`
-	IFace       string   `toml:"iface"`
-	Addresses   []net.IP
-	DNSBLDomain string `toml:"dnsbl_domain"`
+	AllowSites          []string    `toml:"allow_sites"`
+	DenySites           []string    `toml:"deny_sites"`
+	AllowSitesFiles     []string    `toml:"allow_sites_files"`
+	DenySitesFiles      []string    `toml:"deny_sites_files"`
+	SitesReloadInterval Duration    `toml:"sites_reload_interval"`
+	AllowPorts          []PortRange `toml:"allow_ports"`
+	DenyPorts           []int       `toml:"deny_ports"`
+	DenyPortRanges      []PortRange `toml:"deny_port_ranges"`
+	IFace               string      `toml:"iface"`
+	IFaces              []string    `toml:"ifaces"`
+	Addresses           []net.IP
+	AddressWeights      map[string]float64 `toml:"address_weights"`
+	IPv6Prefix          string             `toml:"ipv6_prefix"`
+	IPv6PrefixMode      string             `toml:"ipv6_prefix_mode"`
+	Pools               []PoolConfig       `toml:"pools"`
+	Marks               []MarkConfig       `toml:"marks"`
+	Probe               ProbeConfig        `toml:"probe"`
+	DNSBLDomain         string             `toml:"dnsbl_domain"`
+	DNSBLDomain6        string             `toml:"dnsbl_domain6"`
+	DNSBLCheckInterval  Duration           `toml:"dnsbl_check_interval"`
+	DNSBLCheckTimeout   Duration           `toml:"dnsbl_check_timeout"`
+	Sniff               bool
+	Socket              SocketConfig `toml:"socket"`
+	sites               *atomic.Pointer[siteRules]
+}
+
+// DebugConfig is a set of configurations for debug endpoints
+// served on the metrics port.
+type DebugConfig struct {
+	Enabled      bool
+	AllowFrom    []string `toml:"allow_from"`
+	Token        string
+	allowSubnets []*net.IPNet
+}
+
+// MetricsConfig is a set of configurations for metrics.
+//
+// ResolverCheck is a name resolved by the readiness check.  If empty,
+// the resolver is not checked.
+type MetricsConfig struct {
+	Detailed       bool
+	MaxLabelValues int    `toml:"max_label_values"`
+	ResolverCheck  string `toml:"resolver_check"`
 }
 
 // Config is a struct tagged for TOML for usocksd.
 type Config struct {
-	Log      well.LogConfig `toml:"log"`
-	Incoming IncomingConfig `toml:"incoming"`
-	Outgoing OutgoingConfig `toml:"outgoing"`
+	Log         well.LogConfig    `toml:"log"`
+	AccessLog   AccessLogConfig   `toml:"access_log"`
+	Incoming    IncomingConfig    `toml:"incoming"`
+	Outgoing    OutgoingConfig    `toml:"outgoing"`
+	Metrics     MetricsConfig     `toml:"metrics"`
+	Debug       DebugConfig       `toml:"debug"`
+	Tracing     TracingConfig     `toml:"tracing"`
+	GeoIP       GeoIPConfig       `toml:"geoip"`
+	Feeds       []FeedConfig      `toml:"feeds"`
+	DestDNSBL   DestDNSBLConfig   `toml:"dest_dnsbl"`
+	Transparent TransparentConfig `toml:"transparent"`
+	Rules       []RuleConfig      `toml:"rules"`
 }
 
 // NewConfig creates and initializes Config.
@@ -45,6 +111,8 @@ func NewConfig() *Config {
 	c := new(Config)
 	c.Incoming.Port = defaultPort
 	c.Incoming.MetricsPort = defaultMetricsPort
+	c.Tracing.ServiceName = defaultServiceName
+	c.Tracing.SampleRatio = defaultSampleRatio
 	return c
 }
 
@@ -58,32 +126,122 @@ func (c *Config) Load(path string) error {
 		return errors.New("Unknown config keys in " + path)
 	}
 
-	if len(c.Incoming.AllowFrom) > 0 {
-		subnets := make([]*net.IPNet, 0, len(c.Incoming.AllowFrom))
-		for _, s := range c.Incoming.AllowFrom {
-			if strings.IndexByte(s, '/') == -1 {
-				s = s + "/32"
-			}
-			_, n, err := net.ParseCIDR(s)
-			if err != nil {
-				return errors.New("Invalid network or IP address: " + s)
-			}
-			subnets = append(subnets, n)
+	// IPv6 addresses in incoming.allow_from have been parsed as /32.
+	subnets, err := parseSubnets(c.Incoming.AllowFrom, "/32")
+	if err != nil {
+		return err
+	}
+	c.Incoming.allowSubnets = subnets
+
+	subnets, err = parseSubnets(c.Debug.AllowFrom, "/128")
+	if err != nil {
+		return err
+	}
+	c.Debug.allowSubnets = subnets
+
+	if err := c.AccessLog.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Incoming.Socket.validate("incoming.socket"); err != nil {
+		return err
+	}
+	if c.Incoming.Socket.ConnectTimeout.Duration != 0 {
+		return errors.New("incoming.socket: connect_timeout is only for outgoing connections")
+	}
+	if err := c.Outgoing.Socket.validate("outgoing.socket"); err != nil {
+		return err
+	}
+	if c.Outgoing.Socket.FastOpen {
+		return errors.New("outgoing.socket: fast_open is not supported")
+	}
+	if c.Incoming.NegotiationTimeout.Duration < 0 {
+		return errors.New("negotiation_timeout must not be negative")
+	}
+	if c.Incoming.RelayBufferSize < 0 {
+		return errors.New("relay_buffer_size must not be negative")
+	}
+	if err := c.Transparent.validate(c); err != nil {
+		return err
+	}
+
+	if err := c.Outgoing.compileSites(); err != nil {
+		return err
+	}
+
+	if err := c.loadPools(); err != nil {
+		return err
+	}
+	if err := c.loadMarks(); err != nil {
+		return err
+	}
+	if _, err := validatePrefix(&c.Outgoing); err != nil {
+		return err
+	}
+	if err := c.Outgoing.Probe.validate(); err != nil {
+		return err
+	}
+	for addr, w := range c.Outgoing.AddressWeights {
+		ip := net.ParseIP(addr)
+		if ip == nil || !c.isOutgoingAddress(ip) {
+			return errors.New("address_weights: not an outgoing address: " + addr)
+		}
+		if w <= 0 {
+			return errors.New("address_weights: weight must be positive: " + addr)
 		}
-		c.Incoming.allowSubnets = subnets
 	}
 
-	c.Outgoing.AllowSites = toLowerStrings(c.Outgoing.AllowSites)
-	c.Outgoing.DenySites = toLowerStrings(c.Outgoing.DenySites)
+	if err := c.GeoIP.load(); err != nil {
+		return err
+	}
+
+	if err := c.loadFeeds(); err != nil {
+		return err
+	}
+
+	if err := c.DestDNSBL.load(); err != nil {
+		return err
+	}
+
+	for i := range c.Rules {
+		rc := &c.Rules[i]
+		if err := rc.compile(); err != nil {
+			return err
+		}
+		if len(rc.Countries) > 0 && len(c.GeoIP.CountryDB) == 0 {
+			return errors.New("rules: " + rc.Name + ": countries requires geoip.country_db")
+		}
+		if len(rc.ASNs) > 0 && len(c.GeoIP.ASNDB) == 0 {
+			return errors.New("rules: " + rc.Name + ": asns requires geoip.asn_db")
+		}
+	}
 
 	return nil
 }
 
-func toLowerStrings(l []string) (nl []string) {
+// parseSubnets parses a list of CIDR networks or IP addresses.
+// An IPv4 address is parsed as /32, and an IPv6 address as
+// ipv6Suffix.
+func parseSubnets(l []string, ipv6Suffix string) ([]*net.IPNet, error) {
+	if len(l) == 0 {
+		return nil, nil
+	}
+	subnets := make([]*net.IPNet, 0, len(l))
 	for _, s := range l {
-		nl = append(nl, strings.ToLower(s))
+		if strings.IndexByte(s, '/') == -1 {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+				s = s + ipv6Suffix
+			} else {
+				s = s + "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("Invalid network or IP address: " + s)
+		}
+		subnets = append(subnets, n)
 	}
-	return
+	return subnets, nil
 }
 
 // allowIP tests if ip is allowed to connect to usocksd.
@@ -99,40 +257,39 @@ func (c *Config) allowIP(ip net.IP) bool {
 	return false
 }
 
-func siteMatch(site, match string) bool {
-	if len(match) > 0 && match[0] == '.' {
-		return strings.HasSuffix(site, match)
-	}
-	return site == match
-}
-
 // allowFQDN tests if FQDN is granted to access or not.
 func (c *Config) allowFQDN(fqdn string) bool {
+	return len(c.fqdnDenyReason(fqdn)) == 0
+}
+
+// fqdnDenyReason returns the name of the list that denies FQDN,
+// or an empty string if FQDN is granted to access.
+func (c *Config) fqdnDenyReason(fqdn string) string {
 	fqdn = strings.ToLower(fqdn)
-	if len(c.Outgoing.AllowSites) > 0 {
-		for _, match := range c.Outgoing.AllowSites {
-			if siteMatch(fqdn, match) {
-				goto CHECK_DENY
-			}
-		}
-		return false
+	sr := c.siteRules()
+	if !sr.allow.empty() && !sr.allow.match(fqdn) {
+		return "allow_sites"
 	}
-
-CHECK_DENY:
-	for _, match := range c.Outgoing.DenySites {
-		if siteMatch(fqdn, match) {
-			return false
-		}
+	if sr.deny.match(fqdn) {
+		return "deny_sites"
 	}
-	return true
+	return ""
 }
 
 // allowPort tests if port is legitimate for destination.
 func (c *Config) allowPort(port int) bool {
-	for _, p := range c.Outgoing.DenyPorts {
-		if p == port {
-			return false
-		}
+	return len(c.portDenyReason(port)) == 0
+}
+
+// portDenyReason returns the name of the list that denies port,
+// or an empty string if port is legitimate for destination.
+func (c *Config) portDenyReason(port int) string {
+	if len(c.Outgoing.AllowPorts) > 0 && !portsContain(c.Outgoing.AllowPorts, port) {
+		return "allow_ports"
+	}
+	if containsInt(c.Outgoing.DenyPorts, port) ||
+		portsContain(c.Outgoing.DenyPortRanges, port) {
+		return "deny_ports"
 	}
-	return true
+	return ""
 }
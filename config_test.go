@@ -3,6 +3,7 @@ package usocksd
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -18,11 +19,18 @@ func TestEmptyConfig(t *testing.T) {
 			MetricsPort: defaultMetricsPort,
 		},
 		Outgoing: OutgoingConfig{},
+		Tracing: TracingConfig{
+			ServiceName: defaultServiceName,
+			SampleRatio: defaultSampleRatio,
+		},
 	}
 	options := []cmp.Option{
 		cmpopts.IgnoreUnexported(Config{}),
 		cmpopts.IgnoreUnexported(IncomingConfig{}),
 		cmpopts.IgnoreUnexported(OutgoingConfig{}),
+		cmpopts.IgnoreUnexported(DebugConfig{}),
+		cmpopts.IgnoreUnexported(GeoIPConfig{}),
+		cmpopts.IgnoreUnexported(DestDNSBLConfig{}),
 	}
 	if diff := cmp.Diff(c, expected, options...); diff != "" {
 		t.Fatalf("unexpected config (-actual +expected):\n%s", diff)
@@ -39,6 +47,7 @@ func TestConfig(t *testing.T) {
 	if err := c.Load("test/test1.toml"); err != nil {
 		t.Fatal(err)
 	}
+	noDelay := false
 	expected := &Config{
 		Incoming: IncomingConfig{
 			Port:        1080,
@@ -50,6 +59,7 @@ func TestConfig(t *testing.T) {
 				"10.0.0.0/8",
 				"192.168.1.1",
 			},
+			NegotiationTimeout: Duration{30 * time.Second},
 		},
 		Outgoing: OutgoingConfig{
 			AllowSites: []string{
@@ -60,17 +70,55 @@ func TestConfig(t *testing.T) {
 				".2ch.net",
 				"bad.google.com",
 			},
+			DenySitesFiles:      []string{"test/deny_sites.txt"},
+			SitesReloadInterval: Duration{10 * time.Minute},
 			Addresses: []net.IP{
 				net.ParseIP("12.34.56.78"),
 			},
-			DenyPorts:   []int{22, 25},
-			DNSBLDomain: "zen.spamhaus.org",
+			AddressWeights: map[string]float64{"12.34.56.78": 2},
+			AllowPorts: []PortRange{
+				{22, 22}, {25, 25}, {80, 80}, {443, 443}, {6000, 6063}, {8000, 8999},
+			},
+			DenyPorts:      []int{22, 25},
+			DenyPortRanges: []PortRange{{6000, 6063}},
+			DNSBLDomain:    "zen.spamhaus.org",
+			Socket: SocketConfig{
+				ConnectTimeout: Duration{5 * time.Second},
+				KeepAlive:      Duration{time.Minute},
+				NoDelay:        &noDelay,
+			},
+		},
+		Rules: []RuleConfig{
+			{
+				Name:   "amazon-https",
+				Action: ActionAllow,
+				Sites:  []string{"www.amazon.com"},
+				Ports:  []PortRange{{443, 443}},
+				Schedule: ScheduleConfig{
+					Days:     []string{"mon-fri"},
+					Timezone: "Asia/Tokyo",
+				},
+			},
+			{
+				Name:   "amazon",
+				Action: ActionDeny,
+				Sites:  []string{"www.amazon.com"},
+			},
+		},
+		Tracing: TracingConfig{
+			ServiceName: defaultServiceName,
+			SampleRatio: defaultSampleRatio,
 		},
 	}
 	options := []cmp.Option{
 		cmpopts.IgnoreUnexported(Config{}),
 		cmpopts.IgnoreUnexported(IncomingConfig{}),
 		cmpopts.IgnoreUnexported(OutgoingConfig{}),
+		cmpopts.IgnoreUnexported(DebugConfig{}),
+		cmpopts.IgnoreUnexported(GeoIPConfig{}),
+		cmpopts.IgnoreUnexported(DestDNSBLConfig{}),
+		cmpopts.IgnoreUnexported(RuleConfig{}),
+		cmpopts.IgnoreUnexported(ScheduleConfig{}),
 	}
 	if diff := cmp.Diff(c, expected, options...); diff != "" {
 		t.Fatalf("unexpected config (-actual +expected):\n%s", diff)
@@ -96,12 +144,38 @@ func TestConfig(t *testing.T) {
 	if c.allowFQDN("www.2ch.net") {
 		t.Error("www.2ch.net should be denied")
 	}
+	if c.allowFQDN("Worse.Google.Com") {
+		t.Error("worse.google.com should be denied")
+	}
 	if c.allowPort(25) {
 		t.Error("port 25 must not be allowed")
 	}
 	if !c.allowPort(443) {
 		t.Error("port 443 must be allowed")
 	}
+	if c.allowPort(6001) {
+		t.Error("port 6001 must not be allowed")
+	}
+	if !c.allowPort(8080) {
+		t.Error("port 8080 must be allowed")
+	}
+	if c.allowPort(9443) {
+		t.Error("port 9443 must not be allowed")
+	}
+	monday := time.Date(2023, 4, 3, 12, 0, 0, 0, time.UTC)
+	if rc := c.matchRule(&ruleTarget{host: "WWW.amazon.com", port: 443, time: monday}); rc == nil || rc.Name != "amazon-https" {
+		t.Error("www.amazon.com:443 should match amazon-https:", rc)
+	}
+	if rc := c.matchRule(&ruleTarget{host: "www.amazon.com", port: 80, time: monday}); rc == nil || rc.Name != "amazon" {
+		t.Error("www.amazon.com:80 should match amazon:", rc)
+	}
+	if rc := c.matchRule(&ruleTarget{host: "www.google.com", port: 80, time: monday}); rc != nil {
+		t.Error("www.google.com:80 should not match:", rc)
+	}
+	sunday := time.Date(2023, 4, 2, 12, 0, 0, 0, time.UTC)
+	if d := c.Decide("www.amazon.com", 443, sunday); d.Allowed || d.Rule != "amazon" {
+		t.Error("www.amazon.com:443 should be denied on Sunday:", d)
+	}
 }
 
 func TestConfigFail(t *testing.T) {
@@ -118,3 +192,33 @@ func TestConfigFail(t *testing.T) {
 		t.Error("loadConfig should fail for test3.toml")
 	}
 }
+
+func TestNewServerFail(t *testing.T) {
+	t.Parallel()
+
+	// rules with invalid patterns must not be dropped silently.
+	c := NewConfig()
+	c.Rules = []RuleConfig{{Name: "bad", Action: ActionDeny, Sites: []string{"/(/"}}}
+	if _, err := NewServer(c); err == nil {
+		t.Error("NewServer should fail for an invalid rule")
+	}
+
+	c = NewConfig()
+	c.Outgoing.DenySites = []string{"/(/"}
+	if _, err := NewServer(c); err == nil {
+		t.Error("NewServer should fail for an invalid site pattern")
+	}
+
+	c = NewConfig()
+	c.Outgoing.Addresses = []net.IP{net.ParseIP("127.0.0.2")}
+	c.Outgoing.Pools = []PoolConfig{{Name: "bad", Addresses: []net.IP{net.ParseIP("127.0.0.3")}, Clients: []string{"10.0.0.0/33"}}}
+	if _, err := NewServer(c); err == nil {
+		t.Error("NewServer should fail for an invalid pool")
+	}
+
+	c = NewConfig()
+	c.DestDNSBL.Zones = []DNSBLZoneConfig{{Zone: "sbl.example.com", Codes: []string{"127.0.0.7-127.0.0.4"}}}
+	if _, err := NewServer(c); err == nil {
+		t.Error("NewServer should fail for an invalid DNSBL zone")
+	}
+}
@@ -1,22 +1,78 @@
 package usocksd
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"hash/fnv"
 	"net"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/cybozu-go/usocksd/socks"
-)
-
-const (
-	dialTimeout = 10 * time.Second
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type dialer struct {
 	*AddressGroup
+	pools      []egressPool
+	prefix     *prefixSource
+	ifaces     []string
+	ruleIfaces map[string][]string
+	marks      []MarkConfig
+	socket     *SocketConfig
+	dnsbl      *dnsblChecker
+}
+
+// Check returns an error if all addresses of the shared pool are
+// black-listed.
+func (d dialer) Check(ctx context.Context) error {
+	if len(d.addresses) == 0 {
+		return nil
+	}
+	return d.AddressGroup.Check(ctx)
+}
+
+// source is a source address picked for a destination.
+type source struct {
+	ip      net.IP
+	group   *AddressGroup // nil for addresses from ipv6_prefix
+	pool    string
+	control controlFn
+}
+
+// pickSource returns a source address for dest.  If pool has no
+// address for dest, an address from ipv6_prefix or the shared pool
+// is used.  The address is nil if the shared pool is empty.
+func (d dialer) pickSource(pool *egressPool, r *socks.Request, clientIP, dest net.IP) source {
+	hint := calcHint(clientIP, dest)
+	if pool != nil {
+		if ip := pool.group.PickAddressFor(hint, dest); ip != nil {
+			return source{ip: ip, group: pool.group, pool: pool.Name}
+		}
+	}
+	if ip := d.prefix.pick(r, clientIP, dest); ip != nil {
+		return source{ip: ip, pool: prefixPoolName, control: freebindControl}
+	}
+	return source{ip: d.PickAddressFor(hint, dest), group: d.AddressGroup, pool: defaultPoolName}
+}
+
+type resolvedIPsKey struct{}
+
+// setResolvedIPs records the destination addresses resolved by
+// the rule set so that dialers do not resolve the hostname again.
+func setResolvedIPs(r *socks.Request, ips []net.IP) {
+	r.SetContext(context.WithValue(r.Context(), resolvedIPsKey{}, ips))
+}
+
+// resolvedIPs returns the addresses recorded by setResolvedIPs, or nil.
+func resolvedIPs(r *socks.Request) []net.IP {
+	ips, _ := r.Context().Value(resolvedIPsKey{}).([]net.IP)
+	return ips
 }
 
 func calcHint(caddr, daddr net.IP) uint32 {
@@ -33,36 +89,61 @@ func (d dialer) Dial(r *socks.Request) (net.Conn, error) {
 	}
 
 	destIPs := []net.IP{r.IP}
-	if len(r.Hostname) > 0 {
-		ips, err := net.LookupIP(r.Hostname)
+	if ips := resolvedIPs(r); ips != nil {
+		destIPs = ips
+	} else if len(r.Hostname) > 0 {
+		ips, err := lookupIP(r.Context(), r.Hostname)
 		if err != nil {
 			return nil, err
 		}
 		destIPs = ips
 	}
+	destIPs, err := filterDNSBL(r, d.dnsbl, destIPs)
+	if err != nil {
+		return nil, err
+	}
 
-	deadline, ok := r.Context().Deadline()
+	ctx := r.Context()
+	deadline, ok := ctx.Deadline()
 	if !ok {
-		deadline = time.Now().Add(dialTimeout)
+		deadline = time.Now().Add(d.socket.connectTimeout())
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
 	}
 
-	var err error
+	pool := selectPool(d.pools, r, clientIP)
+	ifaces := d.ifacesFor(r)
+	mark := selectMark(d.marks, r, clientIP)
 	for _, ip := range destIPs {
 		if time.Now().After(deadline) {
 			err = errors.New("dial timeout")
 			break
 		}
 
-		hint := calcHint(clientIP, ip)
+		src := d.pickSource(pool, r, clientIP, ip)
+		if src.ip == nil && len(d.addresses) > 0 {
+			err = errors.New("no outgoing address for " + ip.String())
+			continue
+		}
 		laddr := &net.TCPAddr{
-			IP: d.PickAddress(hint),
+			IP: src.ip,
 		}
 		raddr := &net.TCPAddr{
 			IP:   ip,
 			Port: r.Port,
 		}
-		conn, err2 := net.DialTCP("tcp", laddr, raddr)
+		control := chainControl(src.control, mark.control())
+		conn, iface, err2 := dialVia(ctx, d.socket, laddr, raddr, control, ifaces)
+		if src.group != nil {
+			src.group.reportDial(src.ip, ip, err2)
+		}
 		if err2 == nil {
+			r.AddLogField("pool", src.pool)
+			if len(iface) > 0 {
+				r.AddLogField("iface", iface)
+			}
+			mark.addLogFields(r)
 			return conn, nil
 		}
 		err = err2
@@ -71,6 +152,76 @@ func (d dialer) Dial(r *socks.Request) (net.Conn, error) {
 	return nil, err
 }
 
+// filterDNSBL removes addresses listed on DNSBL from ips.
+// If all of them are listed, the request is denied.
+func filterDNSBL(r *socks.Request, c *dnsblChecker, ips []net.IP) ([]net.IP, error) {
+	if c == nil {
+		return ips, nil
+	}
+
+	var listed *dnsblResult
+	valid := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if res := c.check(r.Context(), ip); res != nil {
+			if listed == nil {
+				listed = res
+			}
+			continue
+		}
+		valid = append(valid, ip)
+	}
+	if len(valid) > 0 {
+		return valid, nil
+	}
+	if listed == nil {
+		return nil, errors.New("no destination address")
+	}
+
+	r.DenyReason = "dnsbl:" + listed.zone
+	r.AddLogField("dnsbl_code", listed.code.String())
+	return nil, fmt.Errorf("%w: %v", socks.ErrDenied, ErrDNSBLListed)
+}
+
+// lookupIP resolves hostname with a span for tracing.
+func lookupIP(ctx context.Context, hostname string) ([]net.IP, error) {
+	ctx, span := socks.Tracer().Start(ctx, "dns.lookup",
+		trace.WithAttributes(attribute.String("dns.name", hostname)))
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", hostname)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.Int("dns.answers", len(ips)))
+	span.End()
+	return ips, err
+}
+
+// dialTCP makes a TCP connection with socket options of sc and a span
+// for tracing.  sc and control may be nil.
+func dialTCP(ctx context.Context, sc *SocketConfig, laddr, raddr *net.TCPAddr, control controlFn) (net.Conn, error) {
+	_, span := socks.Tracer().Start(ctx, "dial",
+		trace.WithAttributes(
+			attribute.String("source.address", laddr.IP.String()),
+			attribute.String("destination.address", raddr.String()),
+		))
+	d := sc.newDialer(control)
+	d.LocalAddr = laddr
+	conn, err := d.DialContext(ctx, "tcp", raddr.String())
+	if err == nil {
+		err = sc.setNoDelay(conn)
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return conn, err
+}
+
 type controlFn = func(network, address string, c syscall.RawConn) error
 
 func bindControl(ifaceName string) controlFn {
@@ -96,38 +247,158 @@ func bindControl(ifaceName string) controlFn {
 
 type dumbDialer struct {
 	*net.Dialer
+	socket *SocketConfig
+	dnsbl  *dnsblChecker
+}
+
+func (d dumbDialer) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.socket.setNoDelay(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
 func (d dumbDialer) Dial(r *socks.Request) (net.Conn, error) {
+	ips := resolvedIPs(r)
+	if ips == nil && d.dnsbl != nil {
+		ips = []net.IP{r.IP}
+		if len(r.Hostname) > 0 {
+			var err error
+			ips, err = lookupIP(r.Context(), r.Hostname)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if ips != nil {
+		ips, err := filterDNSBL(r, d.dnsbl, ips)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(r.Port))
+			conn, err2 := d.dial(r.Context(), addr)
+			if err2 == nil {
+				return conn, nil
+			}
+			err = err2
+		}
+		return nil, err
+	}
+
 	var addr string
 	if len(r.Hostname) > 0 {
 		addr = net.JoinHostPort(r.Hostname, strconv.Itoa(r.Port))
 	} else {
 		addr = net.JoinHostPort(r.IP.String(), strconv.Itoa(r.Port))
 	}
-	return d.DialContext(r.Context(), "tcp", addr)
+	return d.dial(r.Context(), addr)
 }
 
-func createDialer(c *Config) socks.Dialer {
-	if c.Outgoing.IFace != "" {
+func createDialer(c *Config) (socks.Dialer, error) {
+	bl, err := c.DestDNSBL.dnsblChecker()
+	if err != nil {
+		return nil, err
+	}
+	needDialer := len(c.Outgoing.Addresses) > 0 || len(c.Outgoing.Pools) > 0 ||
+		len(c.Outgoing.IPv6Prefix) > 0 || len(c.Outgoing.Marks) > 0 || c.needIfaceFailover()
+	if !needDialer {
+		var control controlFn
+		if c.Outgoing.IFace != "" {
+			control = bindControl(c.Outgoing.IFace)
+		}
 		return dumbDialer{
-			&net.Dialer{
-				KeepAlive: 3 * time.Minute,
-				DualStack: true,
-				Control:   bindControl(c.Outgoing.IFace),
-			},
+			Dialer: c.Outgoing.Socket.newDialer(control),
+			socket: &c.Outgoing.Socket,
+			dnsbl:  bl,
+		}, nil
+	}
+
+	newGroup := func(addresses []net.IP) *AddressGroup {
+		ag := NewAddressGroupDual(addresses, c.Outgoing.DNSBLDomain, c.Outgoing.DNSBLDomain6)
+		ag.CheckInterval = c.Outgoing.DNSBLCheckInterval.Duration
+		ag.CheckTimeout = c.Outgoing.DNSBLCheckTimeout.Duration
+		for addr, w := range c.Outgoing.AddressWeights {
+			if ip := net.ParseIP(addr); containsIP(addresses, ip) {
+				ag.SetWeight(ip, w)
+			}
+		}
+		if c.Outgoing.Probe.enabled() {
+			// marks are not set as they are selected by requests.
+			ag.probeSocket = &c.Outgoing.Socket
+			ag.probeIfaces = c.Outgoing.defaultIfaces()
+			ag.EnableProbe(&c.Outgoing.Probe)
 		}
+		return ag
 	}
 
-	if len(c.Outgoing.Addresses) == 0 {
-		return dumbDialer{
-			&net.Dialer{
-				KeepAlive: 3 * time.Minute,
-				DualStack: true,
-			},
+	pools := make([]egressPool, len(c.Outgoing.Pools))
+	for i := range c.Outgoing.Pools {
+		pc := &c.Outgoing.Pools[i]
+		if pc.clientSubnets == nil && len(pc.Clients) > 0 {
+			// c is not loaded from a file.
+			if err := pc.compile(); err != nil {
+				return nil, err
+			}
+		}
+		pools[i] = egressPool{pc, newGroup(pc.Addresses)}
+	}
+	for i := range c.Outgoing.Marks {
+		mc := &c.Outgoing.Marks[i]
+		if mc.clientSubnets == nil && len(mc.Clients) > 0 {
+			// c is not loaded from a file.
+			if err := mc.compile(); err != nil {
+				return nil, err
+			}
 		}
 	}
+	ruleIfaces := make(map[string][]string)
+	for i := range c.Rules {
+		if rc := &c.Rules[i]; len(rc.IFaces) > 0 {
+			ruleIfaces[rc.Name] = rc.IFaces
+		}
+	}
+	return dialer{
+		AddressGroup: newGroup(c.Outgoing.Addresses),
+		pools:        pools,
+		prefix:       newPrefixSource(c),
+		ifaces:       c.Outgoing.defaultIfaces(),
+		ruleIfaces:   ruleIfaces,
+		marks:        c.Outgoing.Marks,
+		socket:       &c.Outgoing.Socket,
+		dnsbl:        bl,
+	}, nil
+}
 
-	ag := NewAddressGroup(c.Outgoing.Addresses, c.Outgoing.DNSBLDomain)
-	return dialer{ag}
+// WatchAddresses runs the address groups of the dialer of s to check
+// external IP addresses until ctx is canceled.
+func WatchAddresses(ctx context.Context, s *socks.Server) error {
+	d, ok := s.Dialer.(dialer)
+	if !ok {
+		return nil
+	}
+
+	groups := []*AddressGroup{d.AddressGroup}
+	for _, p := range d.pools {
+		groups = append(groups, p.group)
+	}
+	if d.prefix != nil {
+		groups = append(groups, d.prefix.group)
+	}
+	var wg sync.WaitGroup
+	for _, ag := range groups {
+		wg.Add(1)
+		go func(ag *AddressGroup) {
+			defer wg.Done()
+			_ = ag.Run(ctx)
+		}(ag)
+	}
+	wg.Wait()
+	return nil
 }
@@ -0,0 +1,370 @@
+package usocksd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSBLTimeout     = 2 * time.Second
+	defaultDNSBLNegativeTTL = 5 * time.Minute
+	maxDNSBLCacheEntries    = 100000
+)
+
+// ErrDNSBLListed is returned when all addresses of a destination
+// are listed on DNSBL.
+var ErrDNSBLListed = errors.New("destination is listed on DNSBL")
+
+// DNSBLZoneConfig is a DNSBL zone to check destination addresses.
+//
+// Codes is a list of return codes such as "127.0.0.2" or ranges such
+// as "127.0.0.4-127.0.0.7" that mean the address is listed.  If empty,
+// any answer means listed.
+type DNSBLZoneConfig struct {
+	Zone  string
+	Codes []string
+	codes [][2]net.IP
+}
+
+func (zc *DNSBLZoneConfig) compile() error {
+	if len(zc.Zone) == 0 {
+		return errors.New("dest_dnsbl: zone is required")
+	}
+	zc.codes = nil
+	for _, s := range zc.Codes {
+		begin, end, found := strings.Cut(s, "-")
+		b := net.ParseIP(strings.TrimSpace(begin)).To4()
+		e := b
+		if found {
+			e = net.ParseIP(strings.TrimSpace(end)).To4()
+		}
+		if b == nil || e == nil || bytes.Compare(b, e) > 0 {
+			return fmt.Errorf("dest_dnsbl: %s: invalid code: %s", zc.Zone, s)
+		}
+		zc.codes = append(zc.codes, [2]net.IP{b, e})
+	}
+	return nil
+}
+
+// listedBy returns the first return code in addrs that means listed,
+// or nil.
+func (zc *DNSBLZoneConfig) listedBy(addrs []net.IP) net.IP {
+	for _, a := range addrs {
+		if len(zc.codes) == 0 {
+			return a
+		}
+		a4 := a.To4()
+		for _, r := range zc.codes {
+			if bytes.Compare(r[0], a4) <= 0 && bytes.Compare(a4, r[1]) <= 0 {
+				return a
+			}
+		}
+	}
+	return nil
+}
+
+// DestDNSBLConfig is a set of configurations to check destination
+// addresses on DNSBL.
+//
+// Servers is a list of DNS servers in "host:port" form.  If empty,
+// name servers in /etc/resolv.conf are used.  Results are cached
+// according to TTLs of the answers.
+type DestDNSBLConfig struct {
+	Servers []string
+	Timeout Duration
+	Zones   []DNSBLZoneConfig
+	checker *dnsblChecker
+}
+
+func (dc *DestDNSBLConfig) load() error {
+	if len(dc.Zones) == 0 {
+		return nil
+	}
+	for i := range dc.Zones {
+		if err := dc.Zones[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	servers := dc.Servers
+	if len(servers) == 0 {
+		servers = systemNameServers()
+	}
+	timeout := dc.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultDNSBLTimeout
+	}
+	dc.checker = &dnsblChecker{
+		servers: servers,
+		timeout: timeout,
+		zones:   dc.Zones,
+		cache:   make(map[string]dnsblEntry),
+	}
+	return nil
+}
+
+// dnsblChecker returns the checker, or nil if no zone is configured.
+// This must not be called concurrently as it loads dc if dc is not
+// loaded from a file.
+func (dc *DestDNSBLConfig) dnsblChecker() (*dnsblChecker, error) {
+	if dc.checker == nil && len(dc.Zones) > 0 {
+		if err := dc.load(); err != nil {
+			return nil, err
+		}
+	}
+	return dc.checker, nil
+}
+
+// systemNameServers returns name servers in /etc/resolv.conf.
+func systemNameServers() []string {
+	servers := []string{"127.0.0.1:53"}
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return servers
+	}
+	defer f.Close()
+
+	var found []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil {
+			found = append(found, net.JoinHostPort(ip.String(), "53"))
+		}
+	}
+	if len(found) == 0 {
+		return servers
+	}
+	return found
+}
+
+type dnsblEntry struct {
+	addrs  []net.IP
+	expire time.Time
+}
+
+// dnsblChecker looks up DNSBL zones with a cache honouring TTLs.
+type dnsblChecker struct {
+	servers []string
+	timeout time.Duration
+	zones   []DNSBLZoneConfig
+
+	mu    sync.Mutex
+	cache map[string]dnsblEntry
+}
+
+// dnsblResult describes a listed address.
+type dnsblResult struct {
+	zone string
+	code net.IP
+}
+
+// check looks up ip in the zones.  It returns nil if ip is not listed.
+// Lookup failures are treated as not listed, and counted in
+// destDNSBLCheckErrorsCounter.
+func (c *dnsblChecker) check(ctx context.Context, ip net.IP) *dnsblResult {
+	for i := range c.zones {
+		zc := &c.zones[i]
+		name := makeDNSBLDomain(zc.Zone, ip)
+		if len(name) == 0 {
+			continue
+		}
+		addrs, err := c.lookup(ctx, name)
+		if err != nil {
+			destDNSBLCheckErrorsCounter.WithLabelValues(zc.Zone).Inc()
+			continue
+		}
+		if code := zc.listedBy(addrs); code != nil {
+			return &dnsblResult{zone: zc.Zone, code: code}
+		}
+	}
+	return nil
+}
+
+func (c *dnsblChecker) lookup(ctx context.Context, name string) ([]net.IP, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.cache[name]
+	c.mu.Unlock()
+	if ok && now.Before(e.expire) {
+		return e.addrs, nil
+	}
+
+	addrs, ttl, err := c.query(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.cache) >= maxDNSBLCacheEntries {
+		for k, e := range c.cache {
+			if !now.Before(e.expire) {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= maxDNSBLCacheEntries {
+			c.cache = make(map[string]dnsblEntry)
+		}
+	}
+	c.cache[name] = dnsblEntry{addrs: addrs, expire: now.Add(ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// query sends an A query for name to the servers.
+// A name that does not exist results in no addresses.
+func (c *dnsblChecker) query(ctx context.Context, name string) ([]net.IP, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	// unpredictable IDs make off-path spoofing of responses harder.
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil, 0, err
+	}
+	q := dnsmessage.Question{
+		Name:  qname,
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(idBuf[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	req, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, server := range c.servers {
+		var resp dnsmessage.Message
+		resp, err = c.exchange(ctx, "udp", server, req, &msg)
+		if err == nil && resp.Truncated {
+			resp, err = c.exchange(ctx, "tcp", server, req, &msg)
+		}
+		if err != nil {
+			continue
+		}
+		return parseDNSBLResponse(&resp)
+	}
+	return nil, 0, err
+}
+
+// exchange sends req, the packed form of query, to server over network,
+// "udp" or "tcp", and returns the response to query.
+func (c *dnsblChecker) exchange(ctx context.Context, network, server string, req []byte, query *dnsmessage.Message) (dnsmessage.Message, error) {
+	var resp dnsmessage.Message
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		// messages over TCP are prefixed with their length.
+		msg := make([]byte, 2+len(req))
+		binary.BigEndian.PutUint16(msg, uint16(len(req)))
+		copy(msg[2:], req)
+		if _, err := conn.Write(msg); err != nil {
+			return resp, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return resp, err
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return resp, err
+		}
+		if err := resp.Unpack(buf); err != nil {
+			return resp, err
+		}
+		if !isResponseTo(&resp, query) {
+			return resp, errors.New("unexpected DNS response")
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return resp, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return resp, err
+		}
+		if err := resp.Unpack(buf[:n]); err != nil || !isResponseTo(&resp, query) {
+			// ignore unrelated packets.
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// isResponseTo tests if resp is a response to the query msg.
+func isResponseTo(resp, msg *dnsmessage.Message) bool {
+	if !resp.Response || resp.ID != msg.ID || len(resp.Questions) != 1 {
+		return false
+	}
+	q, rq := msg.Questions[0], resp.Questions[0]
+	return rq.Type == q.Type && rq.Class == q.Class &&
+		strings.EqualFold(rq.Name.String(), q.Name.String())
+}
+
+func parseDNSBLResponse(resp *dnsmessage.Message) ([]net.IP, time.Duration, error) {
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		ttl := defaultDNSBLNegativeTTL
+		for _, rr := range resp.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				ttl = time.Duration(soa.MinTTL) * time.Second
+				if rr.Header.TTL < soa.MinTTL {
+					ttl = time.Duration(rr.Header.TTL) * time.Second
+				}
+			}
+		}
+		return nil, ttl, nil
+	default:
+		return nil, 0, fmt.Errorf("DNS error: %s", resp.RCode)
+	}
+
+	var addrs []net.IP
+	ttl := defaultDNSBLNegativeTTL
+	for i, rr := range resp.Answers {
+		a, ok := rr.Body.(*dnsmessage.AResource)
+		if !ok {
+			continue
+		}
+		addrs = append(addrs, net.IP(a.A[:]))
+		if t := time.Duration(rr.Header.TTL) * time.Second; i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	return addrs, ttl, nil
+}
@@ -0,0 +1,273 @@
+package usocksd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/usocksd/socks"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNSBL runs a fake DNSBL server that answers with answers.
+// Names not in answers result in NXDOMAIN.
+func serveDNSBL(t *testing.T, answers map[string]net.IP, queries *int32) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) != 1 {
+				continue
+			}
+			q := req.Questions[0]
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: req.ID, Response: true, RCode: dnsmessage.RCodeNameError},
+				Questions: req.Questions,
+			}
+			name := strings.TrimSuffix(q.Name.String(), ".")
+			if ip, ok := answers[name]; ok {
+				resp.RCode = dnsmessage.RCodeSuccess
+				var a dnsmessage.AResource
+				copy(a.A[:], ip.To4())
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &a,
+				}}
+			}
+			b, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = pc.WriteTo(b, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDestDNSBL(t *testing.T) {
+	t.Parallel()
+
+	var queries int32
+	server := serveDNSBL(t, map[string]net.IP{
+		"2.2.0.192.sbl.example.com": net.ParseIP("127.0.0.2"),
+		"4.2.0.192.sbl.example.com": net.ParseIP("127.0.0.4"),
+		"4.2.0.192.pbl.example.com": net.ParseIP("127.0.0.10"),
+		"5.2.0.192.pbl.example.com": net.ParseIP("127.0.0.5"),
+	}, &queries)
+
+	dc := &DestDNSBLConfig{
+		Servers: []string{server},
+		Zones: []DNSBLZoneConfig{
+			{Zone: "sbl.example.com", Codes: []string{"127.0.0.2"}},
+			{Zone: "pbl.example.com", Codes: []string{"127.0.0.4-127.0.0.7"}},
+		},
+	}
+	if err := dc.load(); err != nil {
+		t.Fatal(err)
+	}
+	c := dc.checker
+
+	testCases := []struct {
+		ip   string
+		zone string
+	}{
+		{"192.0.2.1", ""},
+		{"192.0.2.2", "sbl.example.com"},
+		{"192.0.2.4", ""},
+		{"192.0.2.5", "pbl.example.com"},
+		{"2001:db8::1", ""},
+	}
+	for _, tc := range testCases {
+		res := c.check(context.Background(), net.ParseIP(tc.ip))
+		var zone string
+		if res != nil {
+			zone = res.zone
+		}
+		if zone != tc.zone {
+			t.Errorf("%s: listed by %q, expected %q", tc.ip, zone, tc.zone)
+		}
+	}
+
+	// results are cached.
+	n := atomic.LoadInt32(&queries)
+	for _, tc := range testCases {
+		c.check(context.Background(), net.ParseIP(tc.ip))
+	}
+	if atomic.LoadInt32(&queries) != n {
+		t.Error("DNSBL results should be cached")
+	}
+
+	d := dumbDialer{Dialer: &net.Dialer{}, dnsbl: c}
+	r := &socks.Request{IP: net.ParseIP("192.0.2.2"), Port: 80}
+	r.SetContext(context.Background())
+	_, err := d.Dial(r)
+	if !errors.Is(err, socks.ErrDenied) {
+		t.Errorf("dial to a listed address should be denied: %v", err)
+	}
+	if r.DenyReason != "dnsbl:sbl.example.com" {
+		t.Errorf("unexpected deny reason: %s", r.DenyReason)
+	}
+
+	bad := &DestDNSBLConfig{
+		Zones: []DNSBLZoneConfig{{Zone: "sbl.example.com", Codes: []string{"127.0.0.7-127.0.0.4"}}},
+	}
+	if err := bad.load(); err == nil {
+		t.Error("invalid code range should fail")
+	}
+}
+
+func TestDestDNSBLTruncated(t *testing.T) {
+	t.Parallel()
+
+	// the UDP server only answers with TC bit, and the TCP server
+	// on the same port answers that the address is listed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	answer := func(req []byte, truncated bool) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+			return nil
+		}
+		resp := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: msg.ID, Response: true, Truncated: truncated},
+			Questions: msg.Questions,
+		}
+		if !truncated {
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 2}},
+			}}
+		}
+		b, _ := resp.Pack()
+		return b
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(answer(buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var l [2]byte
+			if _, err := io.ReadFull(conn, l[:]); err == nil {
+				req := make([]byte, binary.BigEndian.Uint16(l[:]))
+				if _, err := io.ReadFull(conn, req); err == nil {
+					b := answer(req, false)
+					binary.BigEndian.PutUint16(l[:], uint16(len(b)))
+					_, _ = conn.Write(append(l[:], b...))
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	dc := &DestDNSBLConfig{
+		Servers: []string{pc.LocalAddr().String()},
+		Zones:   []DNSBLZoneConfig{{Zone: "tc.example.com"}},
+	}
+	if err := dc.load(); err != nil {
+		t.Fatal(err)
+	}
+	if res := dc.checker.check(context.Background(), net.ParseIP("192.0.2.2")); res == nil {
+		t.Error("truncated response should be retried over TCP")
+	}
+
+	// errors are counted.
+	ln.Close()
+	pc.Close()
+	dc = &DestDNSBLConfig{
+		Servers: []string{pc.LocalAddr().String()},
+		Timeout: Duration{100 * time.Millisecond},
+		Zones:   []DNSBLZoneConfig{{Zone: "error.example.com"}},
+	}
+	if err := dc.load(); err != nil {
+		t.Fatal(err)
+	}
+	if res := dc.checker.check(context.Background(), net.ParseIP("192.0.2.2")); res != nil {
+		t.Error("lookup errors should be treated as not listed")
+	}
+	var m dto.Metric
+	if err := destDNSBLCheckErrorsCounter.WithLabelValues("error.example.com").Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if m.GetCounter().GetValue() != 1 {
+		t.Error("lookup errors should be counted:", m.GetCounter().GetValue())
+	}
+}
+
+func TestIsResponseTo(t *testing.T) {
+	t.Parallel()
+
+	name := dnsmessage.MustNewName("2.2.0.192.sbl.example.com.")
+	q := dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+
+	other := q
+	other.Name = dnsmessage.MustNewName("3.2.0.192.sbl.example.com.")
+	txt := q
+	txt.Type = dnsmessage.TypeTXT
+	upper := q
+	upper.Name = dnsmessage.MustNewName("2.2.0.192.SBL.example.com.")
+
+	testCases := []struct {
+		header    dnsmessage.Header
+		questions []dnsmessage.Question
+		expected  bool
+	}{
+		{dnsmessage.Header{ID: 1234, Response: true}, []dnsmessage.Question{q}, true},
+		{dnsmessage.Header{ID: 1234, Response: true}, []dnsmessage.Question{upper}, true},
+		{dnsmessage.Header{ID: 1234}, []dnsmessage.Question{q}, false},
+		{dnsmessage.Header{ID: 4321, Response: true}, []dnsmessage.Question{q}, false},
+		{dnsmessage.Header{ID: 1234, Response: true}, nil, false},
+		{dnsmessage.Header{ID: 1234, Response: true}, []dnsmessage.Question{other}, false},
+		{dnsmessage.Header{ID: 1234, Response: true}, []dnsmessage.Question{txt}, false},
+	}
+	for i, tc := range testCases {
+		resp := &dnsmessage.Message{Header: tc.header, Questions: tc.questions}
+		if isResponseTo(resp, query) != tc.expected {
+			t.Errorf("case %d: isResponseTo should be %v", i, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package usocksd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+const (
+	defaultFeedRefreshInterval = time.Hour
+	feedRetryInterval          = 30 * time.Second
+	feedFetchTimeout           = time.Minute
+)
+
+// feedClient fetches feeds from URLs.
+var feedClient = &http.Client{Timeout: feedFetchTimeout}
+
+// Targets of feeds.
+const (
+	FeedTargetClient      = "client"
+	FeedTargetDestination = "destination"
+)
+
+// FeedConfig is an IP reputation feed.
+//
+// A feed is a plain text file of IP addresses or CIDR networks, one per
+// line.  Text after '#' or ';' is ignored as a comment.  Either File or
+// URL should be specified.
+//
+// Targets is a list of "client" and "destination".  If empty, the feed
+// applies to both.
+type FeedConfig struct {
+	Name            string
+	File            string
+	URL             string   `toml:"url"`
+	RefreshInterval Duration `toml:"refresh_interval"`
+	Targets         []string
+	tree            atomic.Pointer[ipTree]
+}
+
+// ipTree is a binary radix tree of IP networks.
+// size is the number of networks in the tree, excluding those
+// covered by wider networks.
+type ipTree struct {
+	v4   ipNode
+	v6   ipNode
+	size int
+}
+
+type ipNode struct {
+	children [2]*ipNode
+	leaf     bool
+}
+
+func (t *ipTree) root(ip net.IP) (*ipNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &t.v4, ip4
+	}
+	return &t.v6, ip.To16()
+}
+
+// insert adds n to t.
+func (t *ipTree) insert(n *net.IPNet) {
+	nd, ip := t.root(n.IP)
+	ones, bits := n.Mask.Size()
+	if bits != len(ip)*8 {
+		// IPv4 network in IPv6 notation such as ::ffff:0:0/96.
+		ones -= bits - len(ip)*8
+		if ones < 0 {
+			ones = 0
+		}
+	}
+	for i := 0; i < ones; i++ {
+		if nd.leaf {
+			// a wider network is already registered.
+			return
+		}
+		bit := (ip[i/8] >> (7 - i%8)) & 1
+		if nd.children[bit] == nil {
+			nd.children[bit] = new(ipNode)
+		}
+		nd = nd.children[bit]
+	}
+	if nd.leaf {
+		// the same network is already registered.
+		return
+	}
+	// narrower networks are replaced by n.
+	t.size -= nd.leaves()
+	nd.leaf = true
+	nd.children = [2]*ipNode{}
+	t.size++
+}
+
+// leaves returns the number of leaves under nd.
+func (nd *ipNode) leaves() int {
+	if nd.leaf {
+		return 1
+	}
+	n := 0
+	for _, c := range nd.children {
+		if c != nil {
+			n += c.leaves()
+		}
+	}
+	return n
+}
+
+// contains tests if ip is in any of the networks in t.
+func (t *ipTree) contains(ip net.IP) bool {
+	nd, ip := t.root(ip)
+	if ip == nil {
+		return false
+	}
+	for i := 0; i < len(ip)*8; i++ {
+		if nd.leaf {
+			return true
+		}
+		nd = nd.children[(ip[i/8]>>(7-i%8))&1]
+		if nd == nil {
+			return false
+		}
+	}
+	return nd.leaf
+}
+
+// parseFeed reads a feed from r.
+func parseFeed(r io.Reader) (*ipTree, error) {
+	t := new(ipTree)
+	sc := bufio.NewScanner(r)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := sc.Text()
+		if idx := strings.IndexAny(line, "#;"); idx != -1 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		s := fields[0]
+		if strings.IndexByte(s, '/') == -1 {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: invalid IP address: %s", lineno, s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			t.insert(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		t.insert(n)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (fc *FeedConfig) validate() error {
+	if len(fc.Name) == 0 {
+		return errors.New("feeds: name is required")
+	}
+	if (len(fc.File) == 0) == (len(fc.URL) == 0) {
+		return fmt.Errorf("feeds: %s: either file or url must be specified", fc.Name)
+	}
+	for _, target := range fc.Targets {
+		switch target {
+		case FeedTargetClient, FeedTargetDestination:
+		default:
+			return fmt.Errorf("feeds: %s: unknown target: %s", fc.Name, target)
+		}
+	}
+	return nil
+}
+
+// appliesTo returns true if fc applies to target.
+func (fc *FeedConfig) appliesTo(target string) bool {
+	return len(fc.Targets) == 0 || containsString(fc.Targets, target)
+}
+
+// fetch loads the feed from the file or URL.
+func (fc *FeedConfig) fetch(ctx context.Context) (*ipTree, error) {
+	if len(fc.File) > 0 {
+		f, err := os.Open(fc.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseFeed(f)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fc.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := feedClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return parseFeed(resp.Body)
+}
+
+// refresh fetches the feed and replaces the tree.
+func (fc *FeedConfig) refresh(ctx context.Context) error {
+	t, err := fc.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	fc.tree.Store(t)
+	return nil
+}
+
+// contains tests if ip is listed in the feed.
+func (fc *FeedConfig) contains(ip net.IP) bool {
+	t := fc.tree.Load()
+	return t != nil && t.contains(ip)
+}
+
+// loadFeeds validates feeds and loads feeds from files.
+// Feeds from URLs are fetched by WatchFeeds or FetchFeeds.
+func (c *Config) loadFeeds() error {
+	for i := range c.Feeds {
+		fc := &c.Feeds[i]
+		if err := fc.validate(); err != nil {
+			return err
+		}
+		if len(fc.File) == 0 {
+			continue
+		}
+		if err := fc.refresh(context.Background()); err != nil {
+			return fmt.Errorf("feeds: %s: %w", fc.Name, err)
+		}
+	}
+	return nil
+}
+
+// FetchFeeds fetches feeds from URLs once.
+// This is for one-shot use of c such as testing rules; servers
+// should run WatchFeeds instead.
+func FetchFeeds(ctx context.Context, c *Config) error {
+	for i := range c.Feeds {
+		fc := &c.Feeds[i]
+		if len(fc.URL) == 0 {
+			continue
+		}
+		if err := fc.refresh(ctx); err != nil {
+			return fmt.Errorf("feeds: %s: %w", fc.Name, err)
+		}
+	}
+	return nil
+}
+
+// feedsLoaded returns an error if any feed has not been loaded yet.
+func (c *Config) feedsLoaded() error {
+	for i := range c.Feeds {
+		fc := &c.Feeds[i]
+		if fc.tree.Load() == nil {
+			return fmt.Errorf("feed %s is not loaded", fc.Name)
+		}
+	}
+	return nil
+}
+
+// listedIn returns the name of the first feed for target that lists
+// any of ips, or an empty string.
+func (c *Config) listedIn(target string, ips ...net.IP) string {
+	for i := range c.Feeds {
+		fc := &c.Feeds[i]
+		if !fc.appliesTo(target) {
+			continue
+		}
+		for _, ip := range ips {
+			if fc.contains(ip) {
+				return fc.Name
+			}
+		}
+	}
+	return ""
+}
+
+// hasFeedsFor returns true if any feed applies to target.
+func (c *Config) hasFeedsFor(target string) bool {
+	for i := range c.Feeds {
+		if c.Feeds[i].appliesTo(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchFeeds fetches IP reputation feeds from URLs and refreshes
+// feeds at their intervals until ctx is canceled.  Feeds from URLs
+// that have not been fetched yet are retried every 30 seconds.
+// If refreshing fails, the previous list is kept.
+func WatchFeeds(ctx context.Context, c *Config) error {
+	if len(c.Feeds) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := range c.Feeds {
+		fc := &c.Feeds[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchFeed(ctx, fc)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func watchFeed(ctx context.Context, fc *FeedConfig) {
+	interval := fc.RefreshInterval.Duration
+	if interval == 0 {
+		interval = defaultFeedRefreshInterval
+	}
+	wait := interval
+	if fc.tree.Load() == nil {
+		wait = 0
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if err := fc.refresh(ctx); err != nil {
+			_ = log.Error("failed to refresh feed", map[string]interface{}{
+				"feed":      fc.Name,
+				log.FnError: err.Error(),
+			})
+			if fc.tree.Load() == nil {
+				timer.Reset(feedRetryInterval)
+			} else {
+				timer.Reset(interval)
+			}
+			continue
+		}
+		_ = log.Info("refreshed feed", map[string]interface{}{
+			"feed":     fc.Name,
+			"networks": fc.tree.Load().size,
+		})
+		timer.Reset(interval)
+	}
+}
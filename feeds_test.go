@@ -0,0 +1,162 @@
+package usocksd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestIPTree(t *testing.T) {
+	t.Parallel()
+
+	feed := `; Spamhaus DROP style
+1.10.16.0/20 ; SBL256894
+192.0.2.1
+# comment
+2001:db8::/32
+::ffff:198.51.100.0/120
+10.0.0.0/8
+10.1.0.0/16
+`
+	tree, err := parseFeed(strings.NewReader(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.size != 5 {
+		t.Errorf("unexpected number of networks: %d", tree.size)
+	}
+
+	// duplicates and networks covered by wider ones are not counted.
+	tree2, err := parseFeed(strings.NewReader("10.1.0.0/16\n10.2.0.0/16\n10.1.0.0/16\n10.0.0.0/8\n10.3.0.0/16\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree2.size != 1 {
+		t.Errorf("unexpected number of networks: %d", tree2.size)
+	}
+
+	testCases := []struct {
+		ip     string
+		listed bool
+	}{
+		{"1.10.16.1", true},
+		{"1.10.31.255", true},
+		{"1.10.32.0", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"198.51.100.7", true},
+		{"::ffff:192.0.2.1", true},
+		{"10.1.2.3", true},
+		{"10.255.0.1", true},
+		{"11.0.0.1", false},
+	}
+	for _, tc := range testCases {
+		if tree.contains(net.ParseIP(tc.ip)) != tc.listed {
+			t.Errorf("%s: listed should be %v", tc.ip, tc.listed)
+		}
+	}
+
+	if _, err := parseFeed(strings.NewReader("not-an-ip\n")); err == nil {
+		t.Error("invalid feed should fail")
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	t.Parallel()
+
+	var feed atomic.Value
+	feed.Store("203.0.113.0/24\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(feed.Load().(string)))
+	}))
+	defer ts.Close()
+
+	c := NewConfig()
+	c.Feeds = []FeedConfig{
+		{Name: "clients", File: "test/feed.txt", Targets: []string{FeedTargetClient}},
+		{Name: "threats", URL: ts.URL, Targets: []string{FeedTargetDestination}},
+	}
+	if err := c.loadFeeds(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.feedsLoaded(); err == nil {
+		t.Error("feeds from URLs should not be fetched by Load")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchFeeds(ctx, c)
+	for i := 0; c.feedsLoaded() != nil; i++ {
+		if i == 50 {
+			t.Fatal("feeds from URLs should be fetched by WatchFeeds")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ru, err := createRuleSet(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		client string
+		dest   string
+		reason string
+	}{
+		{"192.168.0.1", "198.51.100.1", ""},
+		{"192.0.2.10", "198.51.100.1", "feed:clients"},
+		{"192.168.0.1", "203.0.113.10", "feed:threats"},
+		{"203.0.113.10", "192.0.2.10", ""},
+	}
+	for _, tc := range testCases {
+		r := &socks.Request{
+			IP:   net.ParseIP(tc.dest),
+			Port: 443,
+			Conn: addrConn{addr: &net.TCPAddr{IP: net.ParseIP(tc.client), Port: 10000}},
+		}
+		r.SetContext(context.Background())
+		ok := ru.Match(r)
+		if ok != (len(tc.reason) == 0) || r.DenyReason != tc.reason {
+			t.Errorf("%s -> %s: unexpected result %v %q", tc.client, tc.dest, ok, r.DenyReason)
+		}
+	}
+
+	// destinations must not bypass the feed by a lookup error.
+	r := &socks.Request{
+		Hostname: "nonexistent.invalid",
+		Port:     443,
+		Conn:     addrConn{addr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 10000}},
+	}
+	r.SetContext(context.Background())
+	if ru.Match(r) || r.DenyReason != "resolve" {
+		t.Errorf("unresolvable destination should be denied: %q", r.DenyReason)
+	}
+
+	feed.Store("198.51.100.0/24\n")
+	if err := c.Feeds[1].refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.listedIn(FeedTargetDestination, net.ParseIP("203.0.113.10")) != "" {
+		t.Error("203.0.113.10 should be removed from the feed")
+	}
+	if c.listedIn(FeedTargetDestination, net.ParseIP("198.51.100.1")) != "threats" {
+		t.Error("198.51.100.1 should be listed in the feed")
+	}
+}
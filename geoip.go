@@ -0,0 +1,182 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	// geoIPCheckInterval is the interval between checking updates
+	// of MMDB files.
+	geoIPCheckInterval = time.Minute
+)
+
+// GeoIPConfig is a set of configurations for GeoIP databases.
+//
+// CountryDB and ASNDB are MaxMind DB files such as GeoLite2-Country.mmdb
+// and GeoLite2-ASN.mmdb.
+type GeoIPConfig struct {
+	CountryDB string `toml:"country_db"`
+	ASNDB     string `toml:"asn_db"`
+	geoIP     *geoIP
+}
+
+// mmdbFile is a MaxMind DB loaded from a file.
+//
+// The file is read into memory so that the database can be replaced
+// while lookups are in progress.
+type mmdbFile struct {
+	filename string
+	modTime  time.Time
+	reader   atomic.Pointer[maxminddb.Reader]
+}
+
+func openMMDB(filename string) (*mmdbFile, error) {
+	f := &mmdbFile{filename: filename}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the file again if it has been modified.
+// It returns true if the database is replaced.
+func (f *mmdbFile) reload() (bool, error) {
+	fi, err := os.Stat(f.filename)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(f.modTime) {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(f.filename)
+	if err != nil {
+		return false, err
+	}
+	r, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return false, err
+	}
+	f.reader.Store(r)
+	f.modTime = fi.ModTime()
+	return true, nil
+}
+
+func (f *mmdbFile) lookup(ip net.IP, result interface{}) error {
+	return f.reader.Load().Lookup(ip, result)
+}
+
+// geoInfo is the result of GeoIP lookup.
+type geoInfo struct {
+	country string
+	asn     uint
+	asOrg   string
+}
+
+// geoIP looks up MaxMind DBs.  Either of the databases may be nil.
+type geoIP struct {
+	country *mmdbFile
+	asn     *mmdbFile
+}
+
+func (gc *GeoIPConfig) load() error {
+	if len(gc.CountryDB) == 0 && len(gc.ASNDB) == 0 {
+		return nil
+	}
+
+	g := new(geoIP)
+	if len(gc.CountryDB) > 0 {
+		f, err := openMMDB(gc.CountryDB)
+		if err != nil {
+			return err
+		}
+		g.country = f
+	}
+	if len(gc.ASNDB) > 0 {
+		f, err := openMMDB(gc.ASNDB)
+		if err != nil {
+			return err
+		}
+		g.asn = f
+	}
+	gc.geoIP = g
+	return nil
+}
+
+func (g *geoIP) lookup(ip net.IP) geoInfo {
+	var info geoInfo
+	if g.country != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := g.country.lookup(ip, &record); err == nil {
+			info.country = strings.ToUpper(record.Country.ISOCode)
+		}
+	}
+	if g.asn != nil {
+		var record struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := g.asn.lookup(ip, &record); err == nil {
+			info.asn = record.Number
+			info.asOrg = record.Organization
+		}
+	}
+	return info
+}
+
+// WatchGeoIP reloads GeoIP databases when the files are updated
+// until ctx is canceled.
+//
+// If no databases are configured, this returns immediately.
+func WatchGeoIP(ctx context.Context, c *Config) error {
+	gc := &c.GeoIP
+	if len(gc.CountryDB) == 0 && len(gc.ASNDB) == 0 {
+		return nil
+	}
+	g := gc.geoIP
+	if g == nil {
+		return errors.New("config is not loaded")
+	}
+
+	ticker := time.NewTicker(geoIPCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for _, f := range []*mmdbFile{g.country, g.asn} {
+			if f == nil {
+				continue
+			}
+			updated, err := f.reload()
+			if err != nil {
+				_ = log.Error("failed to reload GeoIP database", map[string]interface{}{
+					"filename":  f.filename,
+					log.FnError: err.Error(),
+				})
+				continue
+			}
+			if updated {
+				_ = log.Info("reloaded GeoIP database", map[string]interface{}{
+					"filename": f.filename,
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package usocksd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mmdbValue encodes a value in MaxMind DB data section format.
+// Supported types are string, uint16, uint32, uint64, []string, and
+// map whose sizes are less than 285.
+func mmdbValue(v interface{}) []byte {
+	ctrl := func(typ, size int) []byte {
+		var ext []byte
+		if size >= 29 {
+			ext = []byte{byte(size - 29)}
+			size = 29
+		}
+		if typ <= 7 {
+			return append([]byte{byte(typ<<5 | size)}, ext...)
+		}
+		return append([]byte{byte(size), byte(typ - 7)}, ext...)
+	}
+	encUint := func(typ int, n uint64) []byte {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		data := bytes.TrimLeft(b[:], "\x00")
+		return append(ctrl(typ, len(data)), data...)
+	}
+
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(2, len(v)), v...)
+	case uint16:
+		return encUint(5, uint64(v))
+	case uint32:
+		return encUint(6, uint64(v))
+	case uint64:
+		return encUint(9, v)
+	case []string:
+		b := ctrl(11, len(v))
+		for _, s := range v {
+			b = append(b, mmdbValue(s)...)
+		}
+		return b
+	case map[string]interface{}:
+		b := ctrl(7, len(v))
+		for k, e := range v {
+			b = append(b, mmdbValue(k)...)
+			b = append(b, mmdbValue(e)...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// writeMMDB writes an IPv4 MaxMind DB with 24-bit records.
+func writeMMDB(t *testing.T, filename string, networks map[string]map[string]interface{}) {
+	t.Helper()
+
+	type node struct {
+		children [2]*node
+		data     int // offset in the data section plus one
+	}
+	root := new(node)
+	var data []byte
+	for cidr, record := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := n.Mask.Size()
+		ip := n.IP.To4()
+		nd := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if nd.children[bit] == nil {
+				nd.children[bit] = new(node)
+			}
+			nd = nd.children[bit]
+		}
+		nd.data = len(data) + 1
+		data = append(data, mmdbValue(record)...)
+	}
+
+	// number nodes in breadth-first order.
+	var nodes []*node
+	index := make(map[*node]int)
+	queue := []*node{root}
+	for len(queue) > 0 {
+		nd := queue[0]
+		queue = queue[1:]
+		index[nd] = len(nodes)
+		nodes = append(nodes, nd)
+		for _, c := range nd.children {
+			if c != nil && c.data == 0 {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	count := len(nodes)
+	var tree []byte
+	for _, nd := range nodes {
+		for _, c := range nd.children {
+			var v int
+			switch {
+			case c == nil:
+				v = count
+			case c.data > 0:
+				v = count + 16 + c.data - 1
+			default:
+				v = index[c]
+			}
+			tree = append(tree, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+
+	buf := append(tree, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, "\xab\xcd\xefMaxMind.com"...)
+	buf = append(buf, mmdbValue(map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test",
+		"languages":                   []string{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+	})...)
+
+	if err := os.WriteFile(filename, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	countryDB := filepath.Join(dir, "country.mmdb")
+	writeMMDB(t, countryDB, map[string]map[string]interface{}{
+		"1.0.0.0/8": {"country": map[string]interface{}{"iso_code": "JP"}},
+		"2.0.0.0/8": {"country": map[string]interface{}{"iso_code": "cn"}},
+	})
+	asnDB := filepath.Join(dir, "asn.mmdb")
+	writeMMDB(t, asnDB, map[string]map[string]interface{}{
+		"1.2.0.0/16": {
+			"autonomous_system_number":       uint32(64512),
+			"autonomous_system_organization": "Example Hosting",
+		},
+	})
+
+	c := NewConfig()
+	c.GeoIP.CountryDB = countryDB
+	c.GeoIP.ASNDB = asnDB
+	c.Rules = []RuleConfig{
+		{Name: "cn", Action: ActionDeny, Countries: []string{"CN"}},
+		{Name: "hosting", Action: ActionDeny, ASNs: []uint{64512}},
+	}
+	if err := c.GeoIP.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.compileRules(); err != nil {
+		t.Fatal(err)
+	}
+
+	info := c.GeoIP.geoIP.lookup(net.ParseIP("1.2.3.4"))
+	if info.country != "JP" || info.asn != 64512 || info.asOrg != "Example Hosting" {
+		t.Errorf("unexpected GeoIP info for 1.2.3.4: %+v", info)
+	}
+	info = c.GeoIP.geoIP.lookup(net.ParseIP("3.3.3.3"))
+	if info != (geoInfo{}) {
+		t.Errorf("unexpected GeoIP info for 3.3.3.3: %+v", info)
+	}
+
+	testCases := []struct {
+		host    string
+		allowed bool
+		country string
+	}{
+		{"1.1.1.1", true, "JP"},
+		{"2.2.2.2", false, "CN"},
+		{"1.2.3.4", false, "JP"},
+		{"3.3.3.3", true, ""},
+	}
+	for _, tc := range testCases {
+		d := c.Decide(tc.host, 443, time.Now())
+		if d.Allowed != tc.allowed || d.Country != tc.country {
+			t.Errorf("%s: unexpected decision: %+v", tc.host, d)
+		}
+	}
+
+	// replace the database
+	writeMMDB(t, countryDB, map[string]map[string]interface{}{
+		"2.0.0.0/8": {"country": map[string]interface{}{"iso_code": "JP"}},
+	})
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(countryDB, future, future); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := c.GeoIP.geoIP.country.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated {
+		t.Error("country database should be reloaded")
+	}
+	if d := c.Decide("2.2.2.2", 443, time.Now()); !d.Allowed || d.Country != "JP" {
+		t.Errorf("2.2.2.2: unexpected decision after reload: %+v", d)
+	}
+}
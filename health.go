@@ -0,0 +1,82 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedListener remembers whether Accept has failed.
+// well.Server stops accepting connections once Accept returns an error.
+type trackedListener struct {
+	net.Listener
+	stopped int32
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		atomic.StoreInt32(&l.stopped, 1)
+	}
+	return conn, err
+}
+
+func (l *trackedListener) accepting() bool {
+	return atomic.LoadInt32(&l.stopped) == 0
+}
+
+// TrackListeners wraps listeners so that readiness checks of
+// the metrics server can tell whether they are accepting connections.
+func TrackListeners(lns []net.Listener) []net.Listener {
+	tlns := make([]net.Listener, len(lns))
+	for i, ln := range lns {
+		tlns[i] = &trackedListener{Listener: ln}
+	}
+	return tlns
+}
+
+func checkListeners(lns []net.Listener) func(context.Context) error {
+	return func(ctx context.Context) error {
+		for _, ln := range lns {
+			tl, ok := ln.(*trackedListener)
+			if !ok {
+				continue
+			}
+			if !tl.accepting() {
+				return errors.New("not accepting on " + ln.Addr().String())
+			}
+		}
+		return nil
+	}
+}
+
+// checkFeeds returns a check that fails until all feeds of c are loaded.
+func checkFeeds(c *Config) func(context.Context) error {
+	return func(ctx context.Context) error {
+		return c.feedsLoaded()
+	}
+}
+
+// resolverCheckTTL is how long the result of the resolver check is
+// cached so that frequent probes do not flood the resolver.
+const resolverCheckTTL = 5 * time.Second
+
+// checkResolver returns a check that resolves name.
+func checkResolver(name string) func(context.Context) error {
+	var mu sync.Mutex
+	var checkedAt time.Time
+	var lastErr error
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(checkedAt) < resolverCheckTTL {
+			return lastErr
+		}
+		_, lastErr = net.DefaultResolver.LookupHost(ctx, name)
+		checkedAt = time.Now()
+		return lastErr
+	}
+}
@@ -0,0 +1,86 @@
+package usocksd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckListeners(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lns := TrackListeners([]net.Listener{ln})
+	check := checkListeners(lns)
+
+	go func() {
+		for {
+			conn, err := lns[0].Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := check(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	ln.Close()
+	for lns[0].(*trackedListener).accepting() {
+		// wait for Accept to fail
+		time.Sleep(time.Millisecond)
+	}
+	if err := check(context.Background()); err == nil {
+		t.Error("closed listener should fail the check")
+	}
+}
+
+func TestCheckFeeds(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Feeds = []FeedConfig{
+		{Name: "clients", File: "test/feed.txt"},
+		{Name: "threats", URL: "http://127.0.0.1:1/feed.txt"},
+	}
+	if err := c.loadFeeds(); err != nil {
+		t.Fatal(err)
+	}
+	check := checkFeeds(c)
+	if err := check(context.Background()); err == nil {
+		t.Error("feeds not fetched yet should fail the check")
+	}
+
+	c.Feeds[1].tree.Store(new(ipTree))
+	if err := check(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckResolver(t *testing.T) {
+	t.Parallel()
+
+	check := checkResolver("nonexistent.invalid")
+	err := check(context.Background())
+	if err == nil {
+		t.Fatal("nonexistent.invalid should not be resolved")
+	}
+	if err2 := check(context.Background()); err2 != err {
+		t.Error("the result should be cached:", err2)
+	}
+
+	if err := checkResolver("localhost")(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,110 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/cybozu-go/netutil"
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+// defaultIfaces returns outgoing interfaces in the order of failover.
+func (oc *OutgoingConfig) defaultIfaces() []string {
+	if len(oc.IFace) == 0 {
+		return oc.IFaces
+	}
+	return append([]string{oc.IFace}, oc.IFaces...)
+}
+
+// needIfaceFailover returns true if interfaces are configured more
+// than the single iface that dumbDialer can handle.
+func (c *Config) needIfaceFailover() bool {
+	if len(c.Outgoing.IFaces) > 0 {
+		return true
+	}
+	for i := range c.Rules {
+		if len(c.Rules[i].IFaces) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ifaceUp returns true if the network interface exists and is up.
+func ifaceUp(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	return err == nil && iface.Flags&net.FlagUp != 0
+}
+
+// isIfaceFailure returns true if err implies that the destination
+// is unreachable via the interface.
+func isIfaceFailure(err error) bool {
+	return netutil.IsNetworkUnreachable(err) ||
+		netutil.IsNoRouteToHost(err) ||
+		errors.Is(err, syscall.ENODEV)
+}
+
+// chainControl returns a control function calling fns in order.
+// nil functions are skipped.
+func chainControl(fns ...controlFn) controlFn {
+	var chain []controlFn
+	for _, fn := range fns {
+		if fn != nil {
+			chain = append(chain, fn)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range chain {
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ifacesFor returns outgoing interfaces for r.  The interfaces of
+// the matched rule take precedence over the default ones.
+func (d dialer) ifacesFor(r *socks.Request) []string {
+	if ifaces := d.ruleIfaces[matchedRule(r)]; len(ifaces) > 0 {
+		return ifaces
+	}
+	return d.ifaces
+}
+
+// dialVia makes a TCP connection with socket options of sc through
+// the first interface in ifaces that is up and can reach raddr.
+// If ifaces is empty, the connection is not bound to any interface.
+// It returns the name of the interface used.
+func dialVia(ctx context.Context, sc *SocketConfig, laddr, raddr *net.TCPAddr, control controlFn, ifaces []string) (net.Conn, string, error) {
+	if len(ifaces) == 0 {
+		conn, err := dialTCP(ctx, sc, laddr, raddr, control)
+		return conn, "", err
+	}
+
+	var err error
+	for _, iface := range ifaces {
+		if !ifaceUp(iface) {
+			err = fmt.Errorf("interface %s is down", iface)
+			continue
+		}
+		conn, err2 := dialTCP(ctx, sc, laddr, raddr, chainControl(control, bindControl(iface)))
+		if err2 == nil {
+			return conn, iface, nil
+		}
+		err = err2
+		if !isIfaceFailure(err2) {
+			break
+		}
+	}
+	return nil, "", err
+}
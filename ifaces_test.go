@@ -0,0 +1,73 @@
+package usocksd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+func TestIfaces(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	raddr := l.Addr().(*net.TCPAddr)
+
+	if !ifaceUp("lo") {
+		t.Skip("lo is not available")
+	}
+	if ifaceUp("nonexistent0") {
+		t.Fatal("nonexistent0 should not be up")
+	}
+
+	conn, iface, err := dialVia(context.Background(), nil, &net.TCPAddr{}, raddr, nil, []string{"nonexistent0", "lo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if iface != "lo" {
+		t.Errorf("should fail over to lo: %s", iface)
+	}
+
+	if _, _, err := dialVia(context.Background(), nil, &net.TCPAddr{}, raddr, nil, []string{"nonexistent0"}); err == nil {
+		t.Error("dial via a down interface should fail")
+	}
+
+	c := NewConfig()
+	c.Outgoing.IFace = "eth9"
+	c.Outgoing.IFaces = []string{"wg0"}
+	c.Outgoing.Addresses = []net.IP{net.ParseIP("127.0.0.2")}
+	c.Rules = []RuleConfig{{Name: "vpn", Action: ActionAllow, IFaces: []string{"wg1", "wg2"}}}
+	sd, err := createDialer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok := sd.(dialer)
+	if !ok {
+		t.Fatal("iface and addresses should be combined")
+	}
+
+	r := &socks.Request{}
+	r.SetContext(context.Background())
+	if ifaces := d.ifacesFor(r); len(ifaces) != 2 || ifaces[0] != "eth9" || ifaces[1] != "wg0" {
+		t.Errorf("unexpected default interfaces: %v", ifaces)
+	}
+	setMatchedRule(r, "vpn")
+	if ifaces := d.ifacesFor(r); len(ifaces) != 2 || ifaces[0] != "wg1" {
+		t.Errorf("unexpected interfaces for rule: %v", ifaces)
+	}
+}
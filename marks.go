@@ -0,0 +1,119 @@
+package usocksd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/cybozu-go/usocksd/socks"
+	"golang.org/x/sys/unix"
+)
+
+// MarkConfig tags outgoing connections of users, client networks, or
+// rules with a firewall mark and a DSCP value.
+//
+// A request uses the first entry that lists its user name, client
+// address, or matched rule.  Mark is set as SO_MARK, and DSCP is set
+// in the IPv4 TOS or IPv6 traffic class field.  Zero values are not set.
+type MarkConfig struct {
+	Name          string
+	Users         []string
+	Clients       []string
+	Rules         []string
+	Mark          uint32
+	DSCP          uint8 `toml:"dscp"`
+	clientSubnets []*net.IPNet
+}
+
+func (mc *MarkConfig) compile() error {
+	if len(mc.Name) == 0 {
+		return errors.New("marks: name is required")
+	}
+	if mc.DSCP > 63 {
+		return fmt.Errorf("marks: %s: dscp must be less than 64", mc.Name)
+	}
+	subnets, err := parseSubnets(mc.Clients, "/128")
+	if err != nil {
+		return fmt.Errorf("marks: %s: %w", mc.Name, err)
+	}
+	mc.clientSubnets = subnets
+	return nil
+}
+
+// loadMarks validates marks.
+func (c *Config) loadMarks() error {
+	for i := range c.Outgoing.Marks {
+		mc := &c.Outgoing.Marks[i]
+		if err := mc.compile(); err != nil {
+			return err
+		}
+		for _, rule := range mc.Rules {
+			if !c.ruleExists(rule) {
+				return fmt.Errorf("marks: %s: unknown rule: %s", mc.Name, rule)
+			}
+		}
+	}
+	return nil
+}
+
+// selectMark returns the mark for r, or nil.
+func selectMark(marks []MarkConfig, r *socks.Request, clientIP net.IP) *MarkConfig {
+	rule := matchedRule(r)
+	for i := range marks {
+		mc := &marks[i]
+		if selects(mc.Users, mc.clientSubnets, mc.Rules, r.Username, clientIP, rule) {
+			return mc
+		}
+	}
+	return nil
+}
+
+// control returns a control function to set the mark and DSCP,
+// or nil if mc is nil.
+func (mc *MarkConfig) control() controlFn {
+	if mc == nil || (mc.Mark == 0 && mc.DSCP == 0) {
+		return nil
+	}
+	mark, tos := int(mc.Mark), int(mc.DSCP)<<2
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		callErr := c.Control(func(fd uintptr) {
+			if mark != 0 {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+				if err != nil {
+					err = fmt.Errorf("failed to set SO_MARK: %w", err)
+					return
+				}
+			}
+			if tos == 0 {
+				return
+			}
+			if network == "tcp6" {
+				err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+			} else {
+				err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to set DSCP: %w", err)
+			}
+		})
+		if callErr != nil {
+			return callErr
+		}
+		return err
+	}
+}
+
+// addLogFields records the mark and DSCP in the access log.
+func (mc *MarkConfig) addLogFields(r *socks.Request) {
+	if mc == nil {
+		return
+	}
+	if mc.Mark != 0 {
+		r.AddLogField("fwmark", mc.Mark)
+	}
+	if mc.DSCP != 0 {
+		r.AddLogField("dscp", mc.DSCP)
+	}
+}
@@ -0,0 +1,103 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/cybozu-go/usocksd/socks"
+	"golang.org/x/sys/unix"
+)
+
+func TestMarks(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Rules = []RuleConfig{{Name: "voice", Action: ActionAllow}}
+	c.Outgoing.Marks = []MarkConfig{
+		{Name: "voice", Rules: []string{"voice"}, DSCP: 46},
+		{Name: "office", Clients: []string{"192.168.0.0/24"}, Mark: 100},
+		{Name: "alice", Users: []string{"alice"}, Mark: 200, DSCP: 10},
+	}
+	if err := c.loadMarks(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		user   string
+		client string
+		rule   string
+		mark   string
+	}{
+		{"", "10.0.0.1", "", ""},
+		{"alice", "10.0.0.1", "", "alice"},
+		{"alice", "192.168.0.1", "", "office"},
+		{"alice", "192.168.0.1", "voice", "voice"},
+	}
+	for _, tc := range testCases {
+		r := &socks.Request{Username: tc.user}
+		r.SetContext(context.Background())
+		if len(tc.rule) > 0 {
+			setMatchedRule(r, tc.rule)
+		}
+		var name string
+		if mc := selectMark(c.Outgoing.Marks, r, net.ParseIP(tc.client)); mc != nil {
+			name = mc.Name
+		}
+		if name != tc.mark {
+			t.Errorf("%+v: unexpected mark %q", tc, name)
+		}
+	}
+
+	bad := NewConfig()
+	bad.Outgoing.Marks = []MarkConfig{{Name: "x", DSCP: 64}}
+	if err := bad.loadMarks(); err == nil {
+		t.Error("too large DSCP should fail")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	mc := &c.Outgoing.Marks[2]
+	conn, err := dialTCP(context.Background(), nil, &net.TCPAddr{}, l.Addr().(*net.TCPAddr), mc.control())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("SO_MARK requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark, tos int
+	err = rc.Control(func(fd uintptr) {
+		mark, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+		tos, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != 200 {
+		t.Errorf("unexpected mark: %d", mark)
+	}
+	if tos != 10<<2 {
+		t.Errorf("unexpected TOS: %d", tos)
+	}
+}
@@ -0,0 +1,46 @@
+package usocksd
+
+import (
+	"github.com/cybozu-go/usocksd/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	addressListedGauge = promauto.With(metrics.Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "outgoing",
+		Name:      "address_listed",
+		Help:      "1 if the external IP address is listed on DNSBL, 0 otherwise",
+	}, []string{"address"})
+	addressValidGauge = promauto.With(metrics.Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "outgoing",
+		Name:      "address_valid",
+		Help:      "1 if the external IP address is used for outgoing connections, 0 otherwise",
+	}, []string{"address"})
+	addressCheckErrorsCounter = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "outgoing",
+		Name:      "address_check_errors_total",
+		Help:      "provides the number of failed DNSBL checks of the external IP address",
+	}, []string{"address"})
+	destDNSBLCheckErrorsCounter = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "dest_dnsbl",
+		Name:      "check_errors_total",
+		Help:      "provides the number of failed DNSBL checks of destination addresses, which are treated as not listed",
+	}, []string{"zone"})
+	addressQuarantinedGauge = promauto.With(metrics.Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "outgoing",
+		Name:      "address_quarantined",
+		Help:      "1 if the external IP address is quarantined and has not recovered yet, 0 otherwise",
+	}, []string{"address"})
+	addressFailuresGauge = promauto.With(metrics.Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "outgoing",
+		Name:      "address_consecutive_failures",
+		Help:      "provides the number of consecutive probe or dial failures of the external IP address",
+	}, []string{"address"})
+)
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	rpprof "runtime/pprof"
+	"strings"
+)
+
+func (s *Server) debugEnabled() bool {
+	return s.EnablePprof || len(s.DebugHandlers) > 0
+}
+
+// allowDebug tests if r is allowed to access debug endpoints.
+//
+// If neither DebugAllowFrom nor DebugToken is set, only requests
+// from loopback addresses are allowed.
+func (s *Server) allowDebug(r *http.Request) bool {
+	if len(s.DebugToken) > 0 {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.DebugToken)) == 1 {
+			return true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	if len(s.DebugAllowFrom) == 0 {
+		return len(s.DebugToken) == 0 && ip.IsLoopback()
+	}
+	for _, n := range s.DebugAllowFrom {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) guardDebug(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowDebug(r) {
+			_ = s.Logger.Warn("denied access to debug endpoint", map[string]interface{}{
+				"remote_addr": r.RemoteAddr,
+				"path":        r.URL.Path,
+			})
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// dumpGoroutines writes stack traces of all goroutines in plain text.
+func dumpGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_ = rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+func (s *Server) debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	if s.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.HandleFunc("/debug/goroutines", dumpGoroutines)
+	}
+	for name, h := range s.DebugHandlers {
+		mux.Handle("/debug/"+name, h)
+	}
+	return mux
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cybozu-go/well"
+)
+
+func TestDebugServer(t *testing.T) {
+	t.Parallel()
+
+	env := well.NewEnvironment(context.Background())
+	s := &Server{
+		Env:         env,
+		EnablePprof: true,
+		DebugHandlers: map[string]http.Handler{
+			"dummy": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "dummy")
+			}),
+		},
+		DebugToken: "secret",
+	}
+	ln, err := net.Listen("tcp", ":30082")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(ln); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, token string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:30082"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if code, _ := get("/debug/dummy", ""); code != http.StatusForbidden {
+		t.Errorf("/debug/dummy without token returned %d", code)
+	}
+	if code, _ := get("/debug/dummy", "bad"); code != http.StatusForbidden {
+		t.Errorf("/debug/dummy with a bad token returned %d", code)
+	}
+	if code, body := get("/debug/dummy", "secret"); code != http.StatusOK || body != "dummy" {
+		t.Errorf("/debug/dummy returned %d: %s", code, body)
+	}
+	if code, body := get("/debug/goroutines", "secret"); code != http.StatusOK || !strings.Contains(body, "goroutine ") {
+		t.Errorf("/debug/goroutines returned %d: %s", code, body)
+	}
+	if code, _ := get("/debug/pprof/", "secret"); code != http.StatusOK {
+		t.Errorf("/debug/pprof/ returned %d", code)
+	}
+	if _, body := get("/metrics", ""); !strings.Contains(body, "go_goroutines") {
+		t.Errorf("Go runtime metrics are missing: %s", body)
+	}
+
+	env.Cancel(nil)
+	if err := env.Wait(); err != nil {
+		t.Error(err)
+	}
+}
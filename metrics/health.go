@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	readinessCheckTimeout = 5 * time.Second
+)
+
+// CheckFunc is a function to check the readiness of a component.
+// It should return a non-nil error if the component is not ready.
+type CheckFunc func(ctx context.Context) error
+
+// Drain makes the readiness check fail so that load balancers stop
+// sending new connections.  Drain cannot be undone.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if s.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "draining")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	names := make([]string, 0, len(s.ReadinessChecks))
+	for name := range s.ReadinessChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var failures []string
+	for _, name := range names {
+		if err := s.ReadinessChecks[name](ctx); err != nil {
+			failures = append(failures, name+": "+err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		fields := map[string]interface{}{
+			"failures": failures,
+		}
+		_ = s.Logger.Warn("readiness check failed", fields)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failures, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cybozu-go/well"
+)
+
+func TestHealthServer(t *testing.T) {
+	t.Parallel()
+
+	env := well.NewEnvironment(context.Background())
+	var notReady int32
+	s := &Server{
+		Env: env,
+		ReadinessChecks: map[string]CheckFunc{
+			"dummy": func(ctx context.Context) error {
+				if atomic.LoadInt32(&notReady) != 0 {
+					return errors.New("not ready")
+				}
+				return nil
+			},
+		},
+	}
+	ln, err := net.Listen("tcp", ":30081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Serve(ln); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(path string) int {
+		resp, err := http.Get("http://localhost:30081" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz returned %d", code)
+	}
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz returned %d", code)
+	}
+
+	atomic.StoreInt32(&notReady, 1)
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz returned %d for a failing check", code)
+	}
+
+	atomic.StoreInt32(&notReady, 0)
+	s.Drain()
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz returned %d while draining", code)
+	}
+	if code := status("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz returned %d while draining", code)
+	}
+
+	env.Cancel(nil)
+	if err := env.Wait(); err != nil {
+		t.Error(err)
+	}
+}
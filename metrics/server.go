@@ -9,7 +9,7 @@ import (
 	"github.com/cybozu-go/log"
 	"github.com/cybozu-go/well"
 	"github.com/prometheus/client_golang/prometheus"
-
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -27,6 +27,13 @@ var (
 	})
 )
 
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
 // Server implements a metrics server.
 type Server struct {
 	// Logger can be used to provide a custom logger.
@@ -44,8 +51,31 @@ type Server struct {
 	// The global environment is used if Env is nil.
 	Env *well.Environment
 
-	once   sync.Once
-	server well.HTTPServer
+	// ReadinessChecks is a set of named checks for /readyz.
+	// The server is ready only when all checks succeed.
+	ReadinessChecks map[string]CheckFunc
+
+	// EnablePprof enables net/http/pprof handlers under /debug/pprof/
+	// and goroutine dumps at /debug/goroutines.
+	EnablePprof bool
+
+	// DebugHandlers are additional handlers served under /debug/.
+	// Keys are paths relative to /debug/.
+	DebugHandlers map[string]http.Handler
+
+	// DebugAllowFrom is a list of networks allowed to access /debug/.
+	DebugAllowFrom []*net.IPNet
+
+	// DebugToken, if not empty, allows access to /debug/ from
+	// any address with "Authorization: Bearer <DebugToken>" header.
+	//
+	// If both DebugAllowFrom and DebugToken are empty, /debug/
+	// is accessible only from loopback addresses.
+	DebugToken string
+
+	once     sync.Once
+	server   well.HTTPServer
+	draining int32
 }
 
 func (s *Server) init() {
@@ -54,8 +84,15 @@ func (s *Server) init() {
 	}
 	s.server.ShutdownTimeout = s.ShutdownTimeout
 	s.server.Env = s.Env
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	if s.debugEnabled() {
+		mux.Handle("/debug/", s.guardDebug(s.debugMux()))
+	}
+	mux.Handle("/", metricsHandler)
 	s.server.Server = &http.Server{
-		Handler: metricsHandler,
+		Handler: mux,
 	}
 }
 
@@ -0,0 +1,144 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+// defaultPoolName is the name of the shared pool of outgoing.addresses.
+const defaultPoolName = "default"
+
+// PoolConfig is a pool of external IP addresses dedicated to users,
+// client networks, or rules.
+//
+// A request uses the first pool that lists its user name, client
+// address, or matched rule.  Other requests use the shared pool of
+// outgoing.addresses.
+type PoolConfig struct {
+	Name          string
+	Addresses     []net.IP
+	Users         []string
+	Clients       []string
+	Rules         []string
+	clientSubnets []*net.IPNet
+}
+
+func (pc *PoolConfig) compile() error {
+	if len(pc.Name) == 0 {
+		return errors.New("pools: name is required")
+	}
+	if pc.Name == defaultPoolName {
+		return fmt.Errorf("pools: %s is reserved", defaultPoolName)
+	}
+	if len(pc.Addresses) == 0 {
+		return fmt.Errorf("pools: %s: addresses are required", pc.Name)
+	}
+	subnets, err := parseSubnets(pc.Clients, "/128")
+	if err != nil {
+		return fmt.Errorf("pools: %s: %w", pc.Name, err)
+	}
+	pc.clientSubnets = subnets
+	return nil
+}
+
+// match returns true if the request from clientIP by user matching
+// rule should use the pool.
+func (pc *PoolConfig) match(user string, clientIP net.IP, rule string) bool {
+	return selects(pc.Users, pc.clientSubnets, pc.Rules, user, clientIP, rule)
+}
+
+// selects returns true if user, clientIP, or rule is in the lists.
+func selects(users []string, subnets []*net.IPNet, rules []string, user string, clientIP net.IP, rule string) bool {
+	if len(rule) > 0 && containsString(rules, rule) {
+		return true
+	}
+	if len(user) > 0 && containsString(users, user) {
+		return true
+	}
+	if clientIP != nil {
+		for _, n := range subnets {
+			if n.Contains(clientIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ruleExists returns true if c has a rule named name.
+func (c *Config) ruleExists(name string) bool {
+	for i := range c.Rules {
+		if c.Rules[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPools validates pools.
+func (c *Config) loadPools() error {
+	names := make(map[string]bool)
+	for i := range c.Outgoing.Pools {
+		pc := &c.Outgoing.Pools[i]
+		if err := pc.compile(); err != nil {
+			return err
+		}
+		if names[pc.Name] {
+			return fmt.Errorf("pools: duplicate name: %s", pc.Name)
+		}
+		names[pc.Name] = true
+		for _, rule := range pc.Rules {
+			if !c.ruleExists(rule) {
+				return fmt.Errorf("pools: %s: unknown rule: %s", pc.Name, rule)
+			}
+		}
+	}
+	return nil
+}
+
+// isOutgoingAddress returns true if ip is in the shared pool or any pool.
+func (c *Config) isOutgoingAddress(ip net.IP) bool {
+	if containsIP(c.Outgoing.Addresses, ip) {
+		return true
+	}
+	for i := range c.Outgoing.Pools {
+		if containsIP(c.Outgoing.Pools[i].Addresses, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type matchedRuleKey struct{}
+
+// setMatchedRule records the name of the rule that allowed r.
+func setMatchedRule(r *socks.Request, name string) {
+	r.SetContext(context.WithValue(r.Context(), matchedRuleKey{}, name))
+}
+
+// matchedRule returns the name recorded by setMatchedRule, or "".
+func matchedRule(r *socks.Request) string {
+	name, _ := r.Context().Value(matchedRuleKey{}).(string)
+	return name
+}
+
+// egressPool is an AddressGroup for a pool.
+type egressPool struct {
+	*PoolConfig
+	group *AddressGroup
+}
+
+// selectPool returns the pool for r, or nil to use the shared pool.
+func selectPool(pools []egressPool, r *socks.Request, clientIP net.IP) *egressPool {
+	rule := matchedRule(r)
+	for i := range pools {
+		if pools[i].match(r.Username, clientIP, rule) {
+			return &pools[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package usocksd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+func TestPools(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	c := NewConfig()
+	c.Outgoing.Addresses = []net.IP{net.ParseIP("127.0.0.2")}
+	c.Outgoing.Pools = []PoolConfig{
+		{Name: "partner", Addresses: []net.IP{net.ParseIP("127.0.0.3")}, Rules: []string{"partner"}},
+		{Name: "alice", Addresses: []net.IP{net.ParseIP("127.0.0.4")}, Users: []string{"alice"}},
+		{Name: "office", Addresses: []net.IP{net.ParseIP("127.0.0.5")}, Clients: []string{"192.168.0.0/24"}},
+		{Name: "v6only", Addresses: []net.IP{net.ParseIP("::1")}, Users: []string{"bob"}},
+	}
+	c.Rules = []RuleConfig{{Name: "partner", Action: ActionAllow, Ports: []PortRange{{port, port}}}}
+	if err := c.loadPools(); err != nil {
+		t.Fatal(err)
+	}
+	sd, err := createDialer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := sd.(dialer)
+
+	testCases := []struct {
+		user   string
+		client string
+		rule   string
+		source string
+	}{
+		{"", "10.0.0.1", "", "127.0.0.2"},
+		{"alice", "10.0.0.1", "", "127.0.0.4"},
+		{"", "192.168.0.10", "", "127.0.0.5"},
+		{"alice", "192.168.0.10", "partner", "127.0.0.3"},
+		{"bob", "10.0.0.1", "", "127.0.0.2"},
+	}
+	for _, tc := range testCases {
+		r := &socks.Request{
+			IP:       net.ParseIP("127.0.0.1"),
+			Port:     port,
+			Username: tc.user,
+			Conn:     addrConn{addr: &net.TCPAddr{IP: net.ParseIP(tc.client), Port: 10000}},
+		}
+		r.SetContext(context.Background())
+		if len(tc.rule) > 0 {
+			setMatchedRule(r, tc.rule)
+		}
+		conn, err := d.Dial(r)
+		if err != nil {
+			t.Errorf("%+v: %v", tc, err)
+			continue
+		}
+		src := conn.LocalAddr().(*net.TCPAddr).IP.String()
+		conn.Close()
+		if src != tc.source {
+			t.Errorf("%+v: unexpected source address %s", tc, src)
+		}
+	}
+
+	bad := NewConfig()
+	bad.Outgoing.Pools = []PoolConfig{{Name: "x", Addresses: []net.IP{net.ParseIP("127.0.0.3")}, Rules: []string{"none"}}}
+	if err := bad.loadPools(); err == nil {
+		t.Error("unknown rule should fail")
+	}
+	bad.Outgoing.Pools = []PoolConfig{{Name: defaultPoolName, Addresses: []net.IP{net.ParseIP("127.0.0.3")}}}
+	if err := bad.loadPools(); err == nil {
+		t.Error("reserved name should fail")
+	}
+}
@@ -0,0 +1,78 @@
+package usocksd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is a range of port numbers.
+//
+// In TOML, it is specified by an integer such as 443, or
+// a string such as "443" or "8000-8999".
+type PortRange struct {
+	Begin int
+	End   int
+}
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (pr *PortRange) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case int64:
+		pr.Begin = int(v)
+		pr.End = int(v)
+	case string:
+		begin, end, found := strings.Cut(v, "-")
+		b, err := strconv.Atoi(strings.TrimSpace(begin))
+		if err != nil {
+			return fmt.Errorf("invalid port range: %s", v)
+		}
+		e := b
+		if found {
+			e, err = strconv.Atoi(strings.TrimSpace(end))
+			if err != nil {
+				return fmt.Errorf("invalid port range: %s", v)
+			}
+		}
+		pr.Begin = b
+		pr.End = e
+	default:
+		return fmt.Errorf("invalid port range: %v", data)
+	}
+
+	if pr.Begin < 0 || pr.End > 65535 || pr.Begin > pr.End {
+		return fmt.Errorf("invalid port range: %d-%d", pr.Begin, pr.End)
+	}
+	return nil
+}
+
+// Contains tests if port is in the range.
+func (pr PortRange) Contains(port int) bool {
+	return pr.Begin <= port && port <= pr.End
+}
+
+func (pr PortRange) String() string {
+	if pr.Begin == pr.End {
+		return strconv.Itoa(pr.Begin)
+	}
+	return fmt.Sprintf("%d-%d", pr.Begin, pr.End)
+}
+
+// portsContain tests if port is in any of l.
+func portsContain(l []PortRange, port int) bool {
+	for _, pr := range l {
+		if pr.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(l []int, n int) bool {
+	for _, e := range l {
+		if e == n {
+			return true
+		}
+	}
+	return false
+}
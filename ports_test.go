@@ -0,0 +1,51 @@
+package usocksd
+
+import (
+	"testing"
+)
+
+func TestPortRange(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		data  interface{}
+		pr    PortRange
+		valid bool
+	}{
+		{int64(443), PortRange{443, 443}, true},
+		{"443", PortRange{443, 443}, true},
+		{"8000-8999", PortRange{8000, 8999}, true},
+		{"8000 - 8999", PortRange{8000, 8999}, true},
+		{"8999-8000", PortRange{}, false},
+		{"1-65536", PortRange{}, false},
+		{int64(-1), PortRange{}, false},
+		{"http", PortRange{}, false},
+		{"80-", PortRange{}, false},
+		{1.5, PortRange{}, false},
+	}
+	for _, tc := range testCases {
+		var pr PortRange
+		err := pr.UnmarshalTOML(tc.data)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("%v should be invalid", tc.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.data, err)
+			continue
+		}
+		if pr != tc.pr {
+			t.Errorf("%v: %v != %v", tc.data, pr, tc.pr)
+		}
+	}
+
+	pr := PortRange{8000, 8999}
+	if !pr.Contains(8000) || !pr.Contains(8999) || pr.Contains(9000) {
+		t.Error("unexpected Contains result")
+	}
+	if pr.String() != "8000-8999" {
+		t.Error(`pr.String() != "8000-8999":`, pr.String())
+	}
+}
@@ -0,0 +1,129 @@
+package usocksd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/cybozu-go/usocksd/socks"
+	"golang.org/x/sys/unix"
+)
+
+// Modes of ipv6_prefix.
+const (
+	PrefixModeSession = "session"
+	PrefixModeUser    = "user"
+)
+
+// prefixPoolName is the pool name of addresses from ipv6_prefix.
+const prefixPoolName = "ipv6_prefix"
+
+func validatePrefix(oc *OutgoingConfig) (*net.IPNet, error) {
+	if len(oc.IPv6Prefix) == 0 {
+		return nil, nil
+	}
+	ip, n, err := net.ParseCIDR(oc.IPv6Prefix)
+	if err != nil {
+		return nil, errors.New("ipv6_prefix: " + err.Error())
+	}
+	if ip.To4() != nil {
+		return nil, errors.New("ipv6_prefix: not an IPv6 prefix: " + oc.IPv6Prefix)
+	}
+	ones, _ := n.Mask.Size()
+	if ones > 120 {
+		return nil, errors.New("ipv6_prefix: too long prefix: " + oc.IPv6Prefix)
+	}
+	// DNSBL checks only the first /64 of the prefix.
+	if ones < 64 && len(oc.DNSBLDomain6) > 0 {
+		return nil, errors.New("ipv6_prefix: prefix shorter than /64 cannot be checked on dnsbl_domain6: " + oc.IPv6Prefix)
+	}
+	switch oc.IPv6PrefixMode {
+	case "", PrefixModeSession, PrefixModeUser:
+	default:
+		return nil, errors.New("ipv6_prefix_mode: unknown mode: " + oc.IPv6PrefixMode)
+	}
+	return n, nil
+}
+
+// prefixSource picks source addresses from an IPv6 prefix.
+//
+// The prefix is checked on DNSBL as a whole by group, so it must be
+// a /64 or longer if DNSBL is used.  While it is listed, addresses
+// from the prefix are not used.
+type prefixSource struct {
+	prefix  *net.IPNet
+	perUser bool
+	group   *AddressGroup
+}
+
+func newPrefixSource(c *Config) *prefixSource {
+	n, err := validatePrefix(&c.Outgoing)
+	if err != nil || n == nil {
+		return nil
+	}
+	group := NewAddressGroupDual([]net.IP{n.IP}, "", c.Outgoing.DNSBLDomain6)
+	group.CheckInterval = c.Outgoing.DNSBLCheckInterval.Duration
+	group.CheckTimeout = c.Outgoing.DNSBLCheckTimeout.Duration
+	return &prefixSource{
+		prefix:  n,
+		perUser: c.Outgoing.IPv6PrefixMode == PrefixModeUser,
+		group:   group,
+	}
+}
+
+// pick returns a source address for dest, or nil if dest is not IPv6
+// or the prefix is listed on DNSBL.
+func (p *prefixSource) pick(r *socks.Request, clientIP, dest net.IP) net.IP {
+	if p == nil || dest.To4() != nil {
+		return nil
+	}
+	if p.group.Check(context.Background()) != nil {
+		return nil
+	}
+
+	host := make([]byte, net.IPv6len)
+	if p.perUser {
+		key := r.Username
+		if len(key) == 0 {
+			key = clientIP.String()
+		}
+		sum := sha256.Sum256([]byte(key))
+		copy(host, sum[:])
+	} else {
+		_, _ = rand.Read(host)
+	}
+	return prefixAddress(p.prefix, host)
+}
+
+// prefixAddress returns the address in n whose host part is taken
+// from host.  The subnet-router anycast address is avoided.
+func prefixAddress(n *net.IPNet, host []byte) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	zero := true
+	for i := range ip {
+		ip[i] = n.IP[i]&n.Mask[i] | host[i]&^n.Mask[i]
+		if host[i]&^n.Mask[i] != 0 {
+			zero = false
+		}
+	}
+	if zero {
+		ip[net.IPv6len-1] |= 1
+	}
+	return ip
+}
+
+// freebindControl allows binding addresses that are not assigned to
+// any interface, such as addresses from a routed prefix.
+func freebindControl(network, address string, c syscall.RawConn) error {
+	var err error
+	callErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_FREEBIND, 1)
+	})
+	if callErr != nil {
+		return callErr
+	}
+	return err
+}
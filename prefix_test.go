@@ -0,0 +1,94 @@
+package usocksd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+func TestPrefixSource(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Outgoing.IPv6Prefix = "2001:db8:1:2::/64"
+	c.Outgoing.IPv6PrefixMode = PrefixModeUser
+	p := newPrefixSource(c)
+	if p == nil {
+		t.Fatal("prefix source should be created")
+	}
+
+	dest := net.ParseIP("2001:db8:ffff::1")
+	client := net.ParseIP("192.168.0.1")
+	alice := &socks.Request{Username: "alice"}
+	bob := &socks.Request{Username: "bob"}
+
+	ip1 := p.pick(alice, client, dest)
+	if !p.prefix.Contains(ip1) {
+		t.Fatalf("%s is not in the prefix", ip1)
+	}
+	if ip2 := p.pick(alice, client, dest); !ip1.Equal(ip2) {
+		t.Errorf("addresses of a user should be the same: %s, %s", ip1, ip2)
+	}
+	if ip2 := p.pick(bob, client, dest); ip1.Equal(ip2) || !p.prefix.Contains(ip2) {
+		t.Errorf("unexpected address for another user: %s", ip2)
+	}
+	if ip := p.pick(alice, client, net.ParseIP("192.0.2.1")); ip != nil {
+		t.Errorf("IPv4 destination should not use the prefix: %s", ip)
+	}
+
+	p.perUser = false
+	ip1 = p.pick(alice, client, dest)
+	ip2 := p.pick(alice, client, dest)
+	if ip1.Equal(ip2) || !p.prefix.Contains(ip1) || !p.prefix.Contains(ip2) {
+		t.Errorf("unexpected addresses for sessions: %s, %s", ip1, ip2)
+	}
+
+	// the prefix is listed on DNSBL.
+	p.group.lock.Lock()
+	p.group.invalids = p.group.addresses
+	p.group.lock.Unlock()
+	if ip := p.pick(alice, client, dest); ip != nil {
+		t.Errorf("listed prefix should not be used: %s", ip)
+	}
+
+	c.Outgoing.IPv6Prefix = "2001:db8::/48"
+	if _, err := validatePrefix(&c.Outgoing); err != nil {
+		t.Error("/48 should be accepted without DNSBL:", err)
+	}
+	c.Outgoing.DNSBLDomain6 = "dnsbl.example.com"
+	if _, err := validatePrefix(&c.Outgoing); err == nil {
+		t.Error("/48 should be rejected with DNSBL")
+	}
+	c.Outgoing.DNSBLDomain6 = ""
+
+	_, n, _ := net.ParseCIDR("2001:db8::/120")
+	if ip := prefixAddress(n, make([]byte, 16)); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("subnet-router anycast address should be avoided: %s", ip)
+	}
+
+	for _, bad := range []string{"192.0.2.0/24", "2001:db8::/124", "2001:db8::"} {
+		c.Outgoing.IPv6Prefix = bad
+		if _, err := validatePrefix(&c.Outgoing); err == nil {
+			t.Errorf("%s should be rejected", bad)
+		}
+	}
+}
+
+func TestFreebind(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	l.Close()
+
+	lc := net.ListenConfig{Control: freebindControl}
+	l, err = lc.Listen(context.Background(), "tcp", "[2001:db8:1:2::5]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
@@ -0,0 +1,285 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/cybozu-go/netutil"
+)
+
+const (
+	defaultProbeInterval   = 30 * time.Second
+	defaultProbeTimeout    = 5 * time.Second
+	defaultProbeFailures   = 3
+	defaultProbeMaxBackoff = 10 * time.Minute
+)
+
+// ProbeConfig is a set of configurations to check the health of
+// external IP addresses.
+//
+// Targets is a list of "IP:port" to which TCP connections are made
+// from each external IP address of the same family.  If Passive is
+// true, failures of dials to destinations are also tracked; they are
+// counted once per destination until the address succeeds.
+//
+// An address that fails Failures times in a row is quarantined, and
+// is not picked while other addresses are available.  The quarantine
+// starts with Interval and doubles up to MaxBackoff each time the
+// address fails again after the quarantine ends.
+type ProbeConfig struct {
+	Targets    []string
+	Interval   Duration
+	Timeout    Duration
+	Passive    bool
+	Failures   int
+	MaxBackoff Duration `toml:"max_backoff"`
+}
+
+func (pc *ProbeConfig) enabled() bool {
+	return len(pc.Targets) > 0 || pc.Passive
+}
+
+func (pc *ProbeConfig) validate() error {
+	for _, target := range pc.Targets {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return fmt.Errorf("probe: %w", err)
+		}
+		if net.ParseIP(host) == nil {
+			return errors.New("probe: target must be an IP address: " + target)
+		}
+	}
+	if pc.Failures < 0 {
+		return errors.New("probe: failures must not be negative")
+	}
+	return nil
+}
+
+func (pc *ProbeConfig) interval() time.Duration {
+	if pc.Interval.Duration > 0 {
+		return pc.Interval.Duration
+	}
+	return defaultProbeInterval
+}
+
+func (pc *ProbeConfig) timeout() time.Duration {
+	if pc.Timeout.Duration > 0 {
+		return pc.Timeout.Duration
+	}
+	return defaultProbeTimeout
+}
+
+func (pc *ProbeConfig) failures() int {
+	if pc.Failures > 0 {
+		return pc.Failures
+	}
+	return defaultProbeFailures
+}
+
+func (pc *ProbeConfig) maxBackoff() time.Duration {
+	if pc.MaxBackoff.Duration > 0 {
+		return pc.MaxBackoff.Duration
+	}
+	return defaultProbeMaxBackoff
+}
+
+// maxFailedDests is the maximum number of destinations tracked for
+// an external IP address by passive checks.
+const maxFailedDests = 256
+
+// addressHealth is the health of an external IP address.
+//
+// dests are the destinations to which dials failed since the last
+// success.  A passive failure is counted only once per destination
+// so that a single unreachable destination does not quarantine the
+// address.
+type addressHealth struct {
+	failures int
+	backoff  time.Duration
+	until    time.Time
+	dests    map[string]bool
+}
+
+// EnableProbe enables health probes of the addresses with pc.
+// Active probes run while Run is running.
+func (a *AddressGroup) EnableProbe(pc *ProbeConfig) {
+	a.lock.Lock()
+	a.probe = pc
+	a.health = make(map[string]*addressHealth)
+	for _, ip := range a.addresses {
+		addressQuarantinedGauge.WithLabelValues(ip.String()).Set(0)
+		addressFailuresGauge.WithLabelValues(ip.String()).Set(0)
+	}
+	a.lock.Unlock()
+}
+
+// probeLoop probes addresses concurrently and periodically until
+// ctx is canceled.
+func (a *AddressGroup) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(a.probe.interval())
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, ip := range a.addresses {
+			wg.Add(1)
+			go func(ip net.IP) {
+				defer wg.Done()
+				err := a.probeAddress(ctx, ip)
+				if err != errNoProbeTarget && ctx.Err() == nil {
+					a.reportHealth(ip, nil, err)
+				}
+			}(ip)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var errNoProbeTarget = errors.New("no probe target")
+
+// probeAddress makes TCP connections from ip to the targets of the
+// same family.  It succeeds if any of the connections succeeds.
+//
+// Connections are made with the socket options and interfaces of
+// outgoing connections as dialer.Dial does.
+func (a *AddressGroup) probeAddress(ctx context.Context, ip net.IP) error {
+	laddr := &net.TCPAddr{IP: ip}
+	err := errNoProbeTarget
+	for _, target := range a.probe.Targets {
+		raddr, err2 := net.ResolveTCPAddr("tcp", target)
+		if err2 != nil {
+			return err2
+		}
+		if (raddr.IP.To4() == nil) != (ip.To4() == nil) {
+			continue
+		}
+		conn, err2 := a.probeDial(ctx, laddr, raddr)
+		if err2 == nil {
+			conn.Close()
+			return nil
+		}
+		err = err2
+	}
+	return err
+}
+
+func (a *AddressGroup) probeDial(ctx context.Context, laddr, raddr *net.TCPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.probe.timeout())
+	defer cancel()
+	conn, _, err := dialVia(ctx, a.probeSocket, laddr, raddr, a.probeControl, a.probeIfaces)
+	return conn, err
+}
+
+// reportDial tracks the result of a dial from ip to dest if passive
+// probing is enabled.  Only errors implying broken routes are
+// counted as failures, once per destination.
+func (a *AddressGroup) reportDial(ip, dest net.IP, err error) {
+	a.lock.Lock()
+	pc := a.probe
+	a.lock.Unlock()
+	if pc == nil || !pc.Passive || ip == nil {
+		return
+	}
+
+	var ne net.Error
+	switch {
+	case err == nil, netutil.IsConnectionRefused(err):
+		a.reportHealth(ip, dest, nil)
+	case netutil.IsNetworkUnreachable(err), netutil.IsNoRouteToHost(err):
+		a.reportHealth(ip, dest, err)
+	case errors.As(err, &ne) && ne.Timeout():
+		a.reportHealth(ip, dest, err)
+	}
+}
+
+// reportHealth updates the health of ip.  dest is the destination
+// of a passive check, or nil for active probes.
+func (a *AddressGroup) reportHealth(ip, dest net.IP, err error) {
+	key := ip.String()
+	now := time.Now()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	h, ok := a.health[key]
+	if !ok {
+		h = new(addressHealth)
+		a.health[key] = h
+	}
+
+	if err == nil {
+		if h.failures > 0 || !h.until.IsZero() {
+			if !h.until.IsZero() {
+				_ = log.Info("external IP address recovered", map[string]interface{}{
+					"address": key,
+				})
+			}
+			*h = addressHealth{}
+		}
+		addressQuarantinedGauge.WithLabelValues(key).Set(0)
+		addressFailuresGauge.WithLabelValues(key).Set(0)
+		return
+	}
+
+	if dest != nil {
+		if h.dests[dest.String()] {
+			return
+		}
+		if h.dests == nil || len(h.dests) >= maxFailedDests {
+			h.dests = make(map[string]bool)
+		}
+		h.dests[dest.String()] = true
+	}
+	h.failures++
+	addressFailuresGauge.WithLabelValues(key).Set(float64(h.failures))
+	if h.until.After(now) {
+		return
+	}
+	// an address failing again after quarantine is quarantined at once.
+	if h.until.IsZero() && h.failures < a.probe.failures() {
+		return
+	}
+
+	if h.backoff == 0 {
+		h.backoff = a.probe.interval()
+	} else {
+		h.backoff *= 2
+	}
+	if max := a.probe.maxBackoff(); h.backoff > max {
+		h.backoff = max
+	}
+	h.until = now.Add(h.backoff)
+	// failures after the quarantine are counted for any destination.
+	h.dests = nil
+	addressQuarantinedGauge.WithLabelValues(key).Set(1)
+	time.AfterFunc(h.backoff, func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if !a.quarantined(ip, time.Now()) {
+			addressQuarantinedGauge.WithLabelValues(key).Set(0)
+		}
+	})
+	_ = log.Warn("quarantine external IP address", map[string]interface{}{
+		"address":   key,
+		"failures":  h.failures,
+		"backoff":   h.backoff.String(),
+		log.FnError: err.Error(),
+	})
+}
+
+// quarantined returns true if ip is in quarantine at now.
+// a.lock must be held.
+func (a *AddressGroup) quarantined(ip net.IP, now time.Time) bool {
+	h, ok := a.health[ip.String()]
+	return ok && h.until.After(now)
+}
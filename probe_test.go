@@ -0,0 +1,205 @@
+package usocksd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestProbeQuarantine(t *testing.T) {
+	t.Parallel()
+
+	ip1 := net.ParseIP("192.0.2.1")
+	ip2 := net.ParseIP("192.0.2.2")
+	a := &AddressGroup{
+		addresses: []net.IP{ip1, ip2},
+		lock:      new(sync.Mutex),
+		valids4:   []net.IP{ip1, ip2},
+	}
+	a.EnableProbe(&ProbeConfig{
+		Passive:    true,
+		Failures:   2,
+		Interval:   Duration{time.Minute},
+		MaxBackoff: Duration{3 * time.Minute},
+	})
+	dest := net.ParseIP("198.51.100.1")
+	dest2 := net.ParseIP("198.51.100.2")
+
+	// find a hint that picks ip1.
+	var hint uint32
+	for ; !a.PickAddressFor(hint, dest).Equal(ip1); hint++ {
+	}
+
+	errBroken := &net.OpError{Op: "dial", Err: timeoutError{}}
+	a.reportDial(ip1, dest, errBroken)
+	if !a.PickAddressFor(hint, dest).Equal(ip1) {
+		t.Error("ip1 should not be quarantined by one failure")
+	}
+	a.reportDial(ip1, dest2, errBroken)
+	if !a.PickAddressFor(hint, dest).Equal(ip2) {
+		t.Error("ip1 should be quarantined")
+	}
+	if h := a.health[ip1.String()]; h.backoff != time.Minute {
+		t.Error("unexpected backoff:", h.backoff)
+	}
+
+	// all addresses quarantined; ip1 is used anyway.
+	a.reportDial(ip2, dest, errBroken)
+	a.reportDial(ip2, dest2, errBroken)
+	if !a.PickAddressFor(hint, dest).Equal(ip1) {
+		t.Error("quarantined addresses should be used when all are quarantined")
+	}
+
+	// quarantine ends, and the address fails again.
+	a.lock.Lock()
+	a.health[ip1.String()].until = time.Now().Add(-time.Second)
+	a.lock.Unlock()
+	a.reportDial(ip1, dest, errBroken)
+	if h := a.health[ip1.String()]; h.backoff != 2*time.Minute || !h.until.After(time.Now()) {
+		t.Error("ip1 should be quarantined again with doubled backoff:", h.backoff)
+	}
+	a.lock.Lock()
+	a.health[ip1.String()].until = time.Now().Add(-time.Second)
+	a.lock.Unlock()
+	a.reportDial(ip1, dest, errBroken)
+	if h := a.health[ip1.String()]; h.backoff != 3*time.Minute {
+		t.Error("backoff should be capped:", h.backoff)
+	}
+
+	// connection refused means the route is healthy.
+	a.reportDial(ip1, dest, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})
+	if !a.PickAddressFor(hint, dest).Equal(ip1) {
+		t.Error("ip1 should recover")
+	}
+}
+
+func TestProbeQuarantineGauge(t *testing.T) {
+	t.Parallel()
+
+	ip := net.ParseIP("192.0.2.101")
+	a := &AddressGroup{
+		addresses: []net.IP{ip},
+		lock:      new(sync.Mutex),
+		valids4:   []net.IP{ip},
+	}
+	a.EnableProbe(&ProbeConfig{Passive: true, Failures: 1, Interval: Duration{100 * time.Millisecond}})
+
+	quarantined := func() float64 {
+		var m dto.Metric
+		if err := addressQuarantinedGauge.WithLabelValues(ip.String()).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	a.reportDial(ip, net.ParseIP("198.51.100.1"), &net.OpError{Op: "dial", Err: timeoutError{}})
+	if v := quarantined(); v != 1 {
+		t.Fatal("the address should be quarantined:", v)
+	}
+	for i := 0; quarantined() != 0; i++ {
+		if i == 50 {
+			t.Fatal("the gauge should be cleared when the quarantine ends")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestProbeSingleDestination(t *testing.T) {
+	t.Parallel()
+
+	ip1 := net.ParseIP("192.0.2.1")
+	ip2 := net.ParseIP("192.0.2.2")
+	a := &AddressGroup{
+		addresses: []net.IP{ip1, ip2},
+		lock:      new(sync.Mutex),
+		valids4:   []net.IP{ip1, ip2},
+	}
+	a.EnableProbe(&ProbeConfig{Passive: true, Failures: 3})
+
+	// a client retrying a blackholed destination.
+	blackhole := net.ParseIP("198.51.100.1")
+	errTimeout := &net.OpError{Op: "dial", Err: timeoutError{}}
+	for i := 0; i < 10; i++ {
+		a.reportDial(ip1, blackhole, errTimeout)
+	}
+	a.lock.Lock()
+	quarantined := a.quarantined(ip1, time.Now())
+	a.lock.Unlock()
+	if quarantined {
+		t.Error("ip1 should not be quarantined by a single destination")
+	}
+
+	// failures to other destinations are counted.
+	a.reportDial(ip1, net.ParseIP("198.51.100.2"), errTimeout)
+	a.reportDial(ip1, net.ParseIP("198.51.100.3"), errTimeout)
+	a.lock.Lock()
+	quarantined = a.quarantined(ip1, time.Now())
+	a.lock.Unlock()
+	if !quarantined {
+		t.Error("ip1 should be quarantined by failures to several destinations")
+	}
+}
+
+func TestProbeAddress(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	var controlled int32
+	a := &AddressGroup{lock: new(sync.Mutex)}
+	a.probeControl = func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&controlled, 1)
+		return nil
+	}
+	a.probe = &ProbeConfig{Targets: []string{closedAddr, l.Addr().String()}}
+	if err := a.probeAddress(context.Background(), net.ParseIP("127.0.0.1")); err != nil {
+		t.Error("probe should succeed:", err)
+	}
+	if atomic.LoadInt32(&controlled) != 2 {
+		t.Error("probes should be dialed with the control of outgoing connections:", controlled)
+	}
+	if err := a.probeAddress(context.Background(), net.ParseIP("::1")); err != errNoProbeTarget {
+		t.Error("IPv6 address should not be probed:", err)
+	}
+
+	a.probe = &ProbeConfig{Targets: []string{closedAddr}}
+	if err := a.probeAddress(context.Background(), net.ParseIP("127.0.0.1")); err == nil {
+		t.Error("probe should fail")
+	}
+
+	if err := (&ProbeConfig{Targets: []string{"example.com:80"}}).validate(); err == nil {
+		t.Error("hostname target should be rejected")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
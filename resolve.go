@@ -0,0 +1,72 @@
+package usocksd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cybozu-go/usocksd/socks"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// resolver answers RESOLVE and RESOLVE_PTR requests.
+//
+// Addresses listed on DNSBL are not answered, and names denied by
+// site rules are not answered for reverse lookups.
+type resolver struct {
+	*Config
+	dnsbl *dnsblChecker
+}
+
+func (rs resolver) Resolve(r *socks.Request) ([]net.IP, error) {
+	ips := resolvedIPs(r)
+	if ips == nil {
+		var err error
+		ips, err = lookupIP(r.Context(), r.Hostname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filterDNSBL(r, rs.dnsbl, ips)
+}
+
+func (rs resolver) ResolvePTR(r *socks.Request) ([]string, error) {
+	names, err := lookupAddr(r.Context(), r.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	var reason string
+	allowed := make([]string, 0, len(names))
+	for _, name := range names {
+		if rsn := rs.fqdnDenyReason(strings.TrimSuffix(name, ".")); len(rsn) > 0 {
+			if len(reason) == 0 {
+				reason = rsn
+			}
+			continue
+		}
+		allowed = append(allowed, name)
+	}
+	if len(allowed) == 0 && len(reason) > 0 {
+		r.DenyReason = reason
+		return nil, fmt.Errorf("%w: PTR names of %s by %s", socks.ErrDenied, r.IP, reason)
+	}
+	return allowed, nil
+}
+
+// lookupAddr resolves names of ip with a span for tracing.
+func lookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	ctx, span := socks.Tracer().Start(ctx, "dns.lookup_ptr",
+		trace.WithAttributes(attribute.String("dns.address", ip.String())))
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.Int("dns.answers", len(names)))
+	span.End()
+	return names, err
+}
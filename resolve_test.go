@@ -0,0 +1,70 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+func TestResolver(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Outgoing.AllowPorts = []PortRange{{443, 443}}
+	if err := c.compileRules(); err != nil {
+		t.Fatal(err)
+	}
+	rs := resolver{Config: c}
+
+	client := addrConn{addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}}
+	r := &socks.Request{Command: socks.CmdResolve, Hostname: "example.test", Conn: client}
+	r.SetContext(context.Background())
+	if !(ruleSet{c}).Match(r) {
+		t.Errorf("RESOLVE should not be denied by ports: %q", r.DenyReason)
+	}
+
+	r = &socks.Request{Command: socks.CmdConnect, Hostname: "example.test", Conn: client}
+	r.SetContext(context.Background())
+	if (ruleSet{c}).Match(r) || r.DenyReason != "allow_ports" {
+		t.Errorf("CONNECT to port 0 should be denied: %q", r.DenyReason)
+	}
+
+	r = &socks.Request{Command: socks.CmdResolve, Hostname: "example.test"}
+	r.SetContext(context.Background())
+	setResolvedIPs(r, []net.IP{net.ParseIP("192.0.2.1")})
+	ips, err := rs.Resolve(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Error("resolved addresses should be reused:", ips)
+	}
+
+	names, err := net.LookupAddr("127.0.0.1")
+	if err != nil || len(names) == 0 {
+		t.Skip("no PTR names for 127.0.0.1:", err)
+	}
+	r = &socks.Request{Command: socks.CmdResolvePTR, IP: net.ParseIP("127.0.0.1")}
+	r.SetContext(context.Background())
+	if answers, err := rs.ResolvePTR(r); err != nil || len(answers) != len(names) {
+		t.Error("unexpected PTR names:", answers, err)
+	}
+
+	c.Outgoing.DenySites = names
+	sr, err := c.Outgoing.loadSites()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Outgoing.sites.Store(sr)
+	r = &socks.Request{Command: socks.CmdResolvePTR, IP: net.ParseIP("127.0.0.1")}
+	r.SetContext(context.Background())
+	if _, err := rs.ResolvePTR(r); !errors.Is(err, socks.ErrDenied) {
+		t.Error("PTR names denied by sites should be denied:", err)
+	}
+	if r.DenyReason != "deny_sites" {
+		t.Error("unexpected deny reason:", r.DenyReason)
+	}
+}
@@ -0,0 +1,251 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// RuleConfig is a rule for destinations.
+//
+// A rule matches a request if all of its conditions match.
+// Empty conditions match any request.
+//
+// Countries and ASNs are looked up by GeoIP databases with the
+// destination IP addresses.  They match if any of the addresses
+// of the destination hostname matches.
+//
+// IFaces is a list of outgoing interfaces, in the order of failover,
+// for requests allowed by the rule.
+type RuleConfig struct {
+	Name      string
+	Action    string
+	Sites     []string
+	Ports     []PortRange
+	Countries []string
+	ASNs      []uint `toml:"asns"`
+	Schedule  ScheduleConfig
+	IFaces    []string `toml:"ifaces"`
+	sites     *siteMatcher
+}
+
+// Actions of RuleConfig.
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+func (rc *RuleConfig) compile() error {
+	if len(rc.Name) == 0 {
+		return errors.New("rules: name is required")
+	}
+	switch rc.Action {
+	case ActionAllow, ActionDeny:
+	default:
+		return fmt.Errorf("rules: %s: unknown action: %s", rc.Name, rc.Action)
+	}
+
+	rc.sites = newSiteMatcher()
+	for _, p := range rc.Sites {
+		if err := rc.sites.add(p); err != nil {
+			return fmt.Errorf("rules: %s: %w", rc.Name, err)
+		}
+	}
+	for i, c := range rc.Countries {
+		rc.Countries[i] = strings.ToUpper(c)
+	}
+	if err := rc.Schedule.compile(); err != nil {
+		return fmt.Errorf("rules: %s: %w", rc.Name, err)
+	}
+	return nil
+}
+
+// ruleTarget is a set of request properties tested by rules.
+type ruleTarget struct {
+	host string
+	port int
+	time time.Time
+
+	// ips are the destination IP addresses, and geos are the results
+	// of GeoIP lookup for them.  These are set only if needed.
+	ips  []net.IP
+	geos []geoInfo
+}
+
+// needDestIPs returns true if the destination IP addresses need to
+// be resolved to test requests.
+func (c *Config) needDestIPs() bool {
+	return c.GeoIP.geoIP != nil || c.hasFeedsFor(FeedTargetDestination)
+}
+
+// resolve sets t.ips and looks up GeoIP databases.
+// If ip is not nil, it is used as the destination address.
+func (c *Config) resolve(ctx context.Context, t *ruleTarget, ip net.IP) error {
+	if ip != nil {
+		t.ips = []net.IP{ip}
+	} else {
+		ips, err := lookupIP(ctx, t.host)
+		if err != nil {
+			return err
+		}
+		t.ips = ips
+	}
+
+	if g := c.GeoIP.geoIP; g != nil {
+		t.geos = make([]geoInfo, len(t.ips))
+		for i, ip := range t.ips {
+			t.geos[i] = g.lookup(ip)
+		}
+	}
+	return nil
+}
+
+// compileRules compiles site lists and rules that are not compiled yet,
+// as Config not loaded from a file has uncompiled rules.  This must be
+// called before testing requests concurrently.
+func (c *Config) compileRules() error {
+	if err := c.Outgoing.compileSites(); err != nil {
+		return err
+	}
+	for i := range c.Rules {
+		rc := &c.Rules[i]
+		if rc.sites != nil {
+			continue
+		}
+		if err := rc.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// match tests if the rule matches t.
+func (rc *RuleConfig) match(t *ruleTarget) bool {
+	if len(rc.Sites) > 0 && !rc.sites.match(t.host) {
+		return false
+	}
+	if len(rc.Ports) > 0 && !portsContain(rc.Ports, t.port) {
+		return false
+	}
+	if len(rc.Countries) > 0 && !rc.matchGeo(t, func(g geoInfo) bool {
+		return containsString(rc.Countries, g.country)
+	}) {
+		return false
+	}
+	if len(rc.ASNs) > 0 && !rc.matchGeo(t, func(g geoInfo) bool {
+		for _, asn := range rc.ASNs {
+			if g.asn == asn {
+				return true
+			}
+		}
+		return false
+	}) {
+		return false
+	}
+	if !rc.Schedule.match(t.time) {
+		return false
+	}
+	return true
+}
+
+// matchGeo tests if any of t.geos satisfies f.
+func (rc *RuleConfig) matchGeo(t *ruleTarget, f func(geoInfo) bool) bool {
+	for _, g := range t.geos {
+		if f(g) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRule returns the first rule that matches t, or nil if no rule
+// matches.
+func (c *Config) matchRule(t *ruleTarget) *RuleConfig {
+	t.host = strings.ToLower(t.host)
+	for i := range c.Rules {
+		rc := &c.Rules[i]
+		if rc.match(t) {
+			return rc
+		}
+	}
+	return nil
+}
+
+// Decision is the result of access rules for a destination.
+type Decision struct {
+	Allowed    bool
+	DenyReason string
+
+	// Rule is the name of the matched rule, if any.
+	Rule string
+
+	// Schedule describes the schedule of the matched rule, if any.
+	Schedule string
+
+	// IPs are the destination addresses resolved to test rules.
+	IPs []net.IP
+
+	// Country and ASN are GeoIP information of the first address
+	// in IPs, if available.
+	Country string
+	ASN     uint
+}
+
+// Decide tests a request to host:port at now with the site lists,
+// port lists, and rules.  Restrictions on clients are not tested.
+// The rules of c must be compiled by Load or NewServer.
+func (c *Config) Decide(host string, port int, now time.Time) Decision {
+	return c.decide(context.Background(), host, port, now)
+}
+
+func (c *Config) decide(ctx context.Context, host string, port int, now time.Time) Decision {
+	if reason := c.fqdnDenyReason(host); len(reason) > 0 {
+		return Decision{DenyReason: reason}
+	}
+	if reason := c.portDenyReason(port); len(reason) > 0 {
+		return Decision{DenyReason: reason}
+	}
+
+	t := &ruleTarget{host: host, port: port, time: now}
+	d := Decision{Allowed: true}
+	if c.needDestIPs() {
+		if err := c.resolve(ctx, t, net.ParseIP(host)); err != nil {
+			return Decision{DenyReason: "resolve"}
+		}
+		d.IPs = t.ips
+		if len(t.geos) > 0 {
+			d.Country = t.geos[0].country
+			d.ASN = t.geos[0].asn
+		}
+	}
+
+	if feed := c.listedIn(FeedTargetDestination, t.ips...); len(feed) > 0 {
+		d.Allowed = false
+		d.DenyReason = "feed:" + feed
+		return d
+	}
+
+	rc := c.matchRule(t)
+	if rc == nil {
+		return d
+	}
+	d.Allowed = rc.Action == ActionAllow
+	d.Rule = rc.Name
+	d.Schedule = rc.Schedule.String()
+	if !d.Allowed {
+		d.DenyReason = "rule:" + rc.Name
+	}
+	return d
+}
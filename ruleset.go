@@ -2,6 +2,7 @@ package usocksd
 
 import (
 	"net"
+	"time"
 
 	"github.com/cybozu-go/log"
 	"github.com/cybozu-go/usocksd/socks"
@@ -15,32 +16,116 @@ func (ru ruleSet) Match(r *socks.Request) bool {
 	clientAddr := r.Conn.RemoteAddr()
 	tca, ok := clientAddr.(*net.TCPAddr)
 
-	if !ru.allowFQDN(r.Hostname) {
+	if reason := ru.fqdnDenyReason(r.Hostname); len(reason) > 0 {
+		r.DenyReason = reason
 		_ = log.Warn("denied access", map[string]interface{}{
 			"client_addr": clientAddr.String(),
 			"fqdn":        r.Hostname,
+			"deny_reason": reason,
 		})
 		return false
 	}
 
 	if ok && !ru.allowIP(tca.IP) {
+		r.DenyReason = "allow_from"
 		_ = log.Warn("denied access", map[string]interface{}{
 			"client_addr": clientAddr.String(),
+			"deny_reason": r.DenyReason,
 		})
 		return false
 	}
 
-	if !ru.allowPort(r.Port) {
+	if ok {
+		if feed := ru.listedIn(FeedTargetClient, tca.IP); len(feed) > 0 {
+			r.DenyReason = "feed:" + feed
+			_ = log.Warn("denied access", map[string]interface{}{
+				"client_addr": clientAddr.String(),
+				"feed":        feed,
+				"deny_reason": r.DenyReason,
+			})
+			return false
+		}
+	}
+
+	// RESOLVE and RESOLVE_PTR requests have no destination port.
+	if reason := ru.portDenyReason(r.Port); !isResolve(r) && len(reason) > 0 {
+		r.DenyReason = reason
 		_ = log.Warn("denied access", map[string]interface{}{
 			"client_addr": clientAddr.String(),
 			"dest_port":   r.Port,
+			"deny_reason": r.DenyReason,
 		})
 		return false
 	}
 
+	t := &ruleTarget{
+		host: r.Hostname,
+		port: r.Port,
+		time: time.Now(),
+	}
+	if ru.needDestIPs() {
+		// Rules and feeds cannot be tested without the addresses.
+		if err := ru.resolve(r.Context(), t, r.IP); err != nil {
+			r.DenyReason = "resolve"
+			_ = log.Warn("denied access", map[string]interface{}{
+				"client_addr": clientAddr.String(),
+				"fqdn":        r.Hostname,
+				"deny_reason": r.DenyReason,
+				log.FnError:   err.Error(),
+			})
+			return false
+		}
+		setResolvedIPs(r, t.ips)
+		if len(t.geos) > 0 {
+			if g := t.geos[0]; len(g.country) > 0 {
+				r.AddLogField("dest_country", g.country)
+			}
+			if g := t.geos[0]; g.asn != 0 {
+				r.AddLogField("dest_asn", g.asn)
+				r.AddLogField("dest_as_org", g.asOrg)
+			}
+		}
+	}
+	if feed := ru.listedIn(FeedTargetDestination, t.ips...); len(feed) > 0 {
+		r.DenyReason = "feed:" + feed
+		_ = log.Warn("denied access", map[string]interface{}{
+			"client_addr": clientAddr.String(),
+			"fqdn":        r.Hostname,
+			"dest_ips":    toStringList(t.ips),
+			"feed":        feed,
+			"deny_reason": r.DenyReason,
+		})
+		return false
+	}
+	if rc := ru.matchRule(t); rc != nil {
+		r.AddLogField("rule", rc.Name)
+		if !rc.Schedule.empty() {
+			r.AddLogField("schedule", rc.Schedule.String())
+		}
+		if rc.Action == ActionDeny {
+			r.DenyReason = "rule:" + rc.Name
+			_ = log.Warn("denied access", map[string]interface{}{
+				"client_addr": clientAddr.String(),
+				"fqdn":        r.Hostname,
+				"dest_port":   r.Port,
+				"deny_reason": r.DenyReason,
+			})
+			return false
+		}
+		setMatchedRule(r, rc.Name)
+	}
+
 	return true
 }
 
-func createRuleSet(c *Config) socks.RuleSet {
-	return ruleSet{c}
+// isResolve returns true if r is a RESOLVE or RESOLVE_PTR request.
+func isResolve(r *socks.Request) bool {
+	return r.Command == socks.CmdResolve || r.Command == socks.CmdResolvePTR
+}
+
+func createRuleSet(c *Config) (socks.RuleSet, error) {
+	if err := c.compileRules(); err != nil {
+		return nil, err
+	}
+	return ruleSet{c}, nil
 }
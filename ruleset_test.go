@@ -0,0 +1,55 @@
+package usocksd
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+func TestRuleSetGeoResolveError(t *testing.T) {
+	t.Parallel()
+
+	countryDB := filepath.Join(t.TempDir(), "country.mmdb")
+	writeMMDB(t, countryDB, map[string]map[string]interface{}{
+		"2.0.0.0/8": {"country": map[string]interface{}{"iso_code": "CN"}},
+	})
+
+	c := NewConfig()
+	c.GeoIP.CountryDB = countryDB
+	c.Rules = []RuleConfig{{Name: "cn", Action: ActionDeny, Countries: []string{"CN"}}}
+	if err := c.GeoIP.load(); err != nil {
+		t.Fatal(err)
+	}
+	ru, err := createRuleSet(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a lookup error must not skip the deny rule.
+	r := &socks.Request{
+		Hostname: "nonexistent.invalid",
+		Port:     443,
+		Conn:     addrConn{addr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 10000}},
+	}
+	r.SetContext(context.Background())
+	if ru.Match(r) || r.DenyReason != "resolve" {
+		t.Errorf("unresolvable destination should be denied: %q", r.DenyReason)
+	}
+	if d := c.Decide("nonexistent.invalid", 443, time.Now()); d.Allowed || d.DenyReason != "resolve" {
+		t.Error("unexpected decision:", d)
+	}
+
+	r = &socks.Request{
+		IP:   net.ParseIP("2.2.2.2"),
+		Port: 443,
+		Conn: addrConn{addr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 10000}},
+	}
+	r.SetContext(context.Background())
+	if ru.Match(r) || r.DenyReason != "rule:cn" {
+		t.Errorf("2.2.2.2 should be denied by the rule: %q", r.DenyReason)
+	}
+}
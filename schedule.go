@@ -0,0 +1,170 @@
+package usocksd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// minuteRange is a range of minutes in a day.
+// If begin > end, the range wraps around midnight.
+type minuteRange struct {
+	begin int
+	end   int
+}
+
+func (mr minuteRange) contains(m int) bool {
+	if mr.begin <= mr.end {
+		return mr.begin <= m && m < mr.end
+	}
+	return mr.begin <= m || m < mr.end
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ScheduleConfig restricts a rule to certain days and hours.
+//
+// Days is a list of weekdays such as "mon" or ranges such as "mon-fri".
+// Hours is a list of time ranges such as "09:00-18:00".  A range such as
+// "22:00-06:00" wraps around midnight, and the part after midnight
+// belongs to the day when the range begins.  Timezone is an IANA time zone
+// name such as "Asia/Tokyo"; the local time zone is used if empty.
+//
+// Empty days or hours match any day or time.
+type ScheduleConfig struct {
+	Days     []string
+	Hours    []string
+	Timezone string
+
+	days  [7]bool
+	hours []minuteRange
+	loc   *time.Location
+}
+
+func (sc *ScheduleConfig) compile() error {
+	sc.loc = time.Local
+	if len(sc.Timezone) > 0 {
+		loc, err := time.LoadLocation(sc.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+		sc.loc = loc
+	}
+
+	sc.days = [7]bool{}
+	for _, d := range sc.Days {
+		begin, end, found := strings.Cut(strings.ToLower(d), "-")
+		b, ok := weekdays[strings.TrimSpace(begin)]
+		if !ok {
+			return fmt.Errorf("invalid days: %s", d)
+		}
+		e := b
+		if found {
+			e, ok = weekdays[strings.TrimSpace(end)]
+			if !ok {
+				return fmt.Errorf("invalid days: %s", d)
+			}
+		}
+		for wd := b; ; wd = (wd + 1) % 7 {
+			sc.days[wd] = true
+			if wd == e {
+				break
+			}
+		}
+	}
+
+	sc.hours = nil
+	for _, h := range sc.Hours {
+		begin, end, found := strings.Cut(h, "-")
+		if !found {
+			return fmt.Errorf("invalid hours: %s", h)
+		}
+		b, err := parseClock(begin)
+		if err != nil {
+			return fmt.Errorf("invalid hours: %s", h)
+		}
+		e, err := parseClock(end)
+		if err != nil {
+			if strings.TrimSpace(end) != "24:00" {
+				return fmt.Errorf("invalid hours: %s", h)
+			}
+			e = 24 * 60
+		}
+		sc.hours = append(sc.hours, minuteRange{b, e})
+	}
+	return nil
+}
+
+// empty returns true if sc matches any time.
+func (sc *ScheduleConfig) empty() bool {
+	return len(sc.Days) == 0 && len(sc.Hours) == 0
+}
+
+// match tests if t is within the schedule.
+func (sc *ScheduleConfig) match(t time.Time) bool {
+	if sc.empty() {
+		return true
+	}
+	if sc.loc != nil {
+		t = t.In(sc.loc)
+	}
+	day := t.Weekday()
+	if len(sc.hours) == 0 {
+		return sc.matchDay(day)
+	}
+	m := t.Hour()*60 + t.Minute()
+	for _, mr := range sc.hours {
+		if !mr.contains(m) {
+			continue
+		}
+		// the part after midnight of a wrapping range belongs to
+		// the day when the range begins.
+		if mr.begin > mr.end && m < mr.end {
+			if sc.matchDay((day + 6) % 7) {
+				return true
+			}
+			continue
+		}
+		if sc.matchDay(day) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc *ScheduleConfig) matchDay(wd time.Weekday) bool {
+	return len(sc.Days) == 0 || sc.days[wd]
+}
+
+func (sc *ScheduleConfig) String() string {
+	if sc.empty() {
+		return ""
+	}
+	var parts []string
+	if len(sc.Days) > 0 {
+		parts = append(parts, strings.Join(sc.Days, ","))
+	}
+	if len(sc.Hours) > 0 {
+		parts = append(parts, strings.Join(sc.Hours, ","))
+	}
+	if len(sc.Timezone) > 0 {
+		parts = append(parts, sc.Timezone)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,85 @@
+package usocksd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	t.Parallel()
+
+	sc := &ScheduleConfig{
+		Days:     []string{"Mon-Fri", "sun"},
+		Hours:    []string{"09:00-12:00", "22:00-02:00"},
+		Timezone: "Asia/Tokyo",
+	}
+	if err := sc.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	jst := time.FixedZone("JST", 9*60*60)
+	testCases := []struct {
+		t     time.Time
+		match bool
+	}{
+		{time.Date(2023, 4, 3, 9, 0, 0, 0, jst), true},       // Monday
+		{time.Date(2023, 4, 3, 11, 59, 0, 0, jst), true},     // Monday
+		{time.Date(2023, 4, 3, 12, 0, 0, 0, jst), false},     // Monday
+		{time.Date(2023, 4, 3, 23, 0, 0, 0, jst), true},      // Monday
+		{time.Date(2023, 4, 4, 1, 0, 0, 0, jst), true},       // Tuesday
+		{time.Date(2023, 4, 8, 10, 0, 0, 0, jst), false},     // Saturday
+		{time.Date(2023, 4, 9, 10, 0, 0, 0, jst), true},      // Sunday
+		{time.Date(2023, 4, 3, 0, 30, 0, 0, time.UTC), true}, // Monday 09:30 JST
+	}
+	for _, tc := range testCases {
+		if sc.match(tc.t) != tc.match {
+			t.Errorf("%v: match should be %v", tc.t, tc.match)
+		}
+	}
+
+	if sc.String() != "Mon-Fri,sun 09:00-12:00,22:00-02:00 Asia/Tokyo" {
+		t.Error("unexpected string:", sc.String())
+	}
+
+	sc = &ScheduleConfig{Days: []string{"fri-mon"}, Hours: []string{"18:00-24:00"}}
+	if err := sc.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !sc.match(time.Date(2023, 4, 2, 23, 59, 0, 0, time.Local)) {
+		t.Error("Sunday 23:59 should match")
+	}
+	if sc.match(time.Date(2023, 4, 5, 19, 0, 0, 0, time.Local)) {
+		t.Error("Wednesday should not match")
+	}
+
+	// the part after midnight belongs to Friday.
+	sc = &ScheduleConfig{Days: []string{"fri"}, Hours: []string{"22:00-02:00"}}
+	if err := sc.compile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		t     time.Time
+		match bool
+	}{
+		{time.Date(2023, 4, 7, 23, 0, 0, 0, time.Local), true},  // Friday
+		{time.Date(2023, 4, 8, 1, 0, 0, 0, time.Local), true},   // Saturday
+		{time.Date(2023, 4, 8, 2, 0, 0, 0, time.Local), false},  // Saturday
+		{time.Date(2023, 4, 8, 23, 0, 0, 0, time.Local), false}, // Saturday
+		{time.Date(2023, 4, 7, 1, 0, 0, 0, time.Local), false},  // Friday
+	} {
+		if sc.match(tc.t) != tc.match {
+			t.Errorf("%v: match should be %v", tc.t, tc.match)
+		}
+	}
+
+	for _, sc := range []*ScheduleConfig{
+		{Days: []string{"monday"}},
+		{Hours: []string{"9-17"}},
+		{Hours: []string{"09:00"}},
+		{Timezone: "Mars/Olympus"},
+	} {
+		if err := sc.compile(); err == nil {
+			t.Errorf("%v should be invalid", sc)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package usocksd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
 	"strconv"
 
 	"github.com/cybozu-go/usocksd/metrics"
@@ -10,9 +13,30 @@ import (
 )
 
 // Listeners returns a list of net.Listener.
+// Listeners for transparent proxy follow those for SOCKS.
+// Use SplitListeners to tell them apart.
+//
+// Accepted connections are configured with incoming socket options
+// as described in SocketListeners.
 func Listeners(c *Config) ([]net.Listener, error) {
+	lns, err := socksListeners(c)
+	if err != nil {
+		return nil, err
+	}
+	tlns, err := transparentListeners(c)
+	if err != nil {
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil, err
+	}
+	return SocketListeners(c, append(lns, tlns...)), nil
+}
+
+func socksListeners(c *Config) ([]net.Listener, error) {
+	lc := c.Incoming.Socket.listenConfig()
 	if len(c.Incoming.Addresses) == 0 {
-		ln, err := net.Listen("tcp", ":"+strconv.Itoa(c.Incoming.Port))
+		ln, err := lc.Listen(context.Background(), "tcp", ":"+strconv.Itoa(c.Incoming.Port))
 		if err != nil {
 			return nil, err
 		}
@@ -22,7 +46,7 @@ func Listeners(c *Config) ([]net.Listener, error) {
 	lns := make([]net.Listener, len(c.Incoming.Addresses))
 	for i, a := range c.Incoming.Addresses {
 		addr := net.JoinHostPort(a.String(), strconv.Itoa(c.Incoming.Port))
-		ln, err := net.Listen("tcp", addr)
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
 		if err != nil {
 			for j := 0; j < i; j++ {
 				lns[j].Close()
@@ -41,14 +65,75 @@ func MetricsListener(c *Config) (net.Listener, error) {
 }
 
 // NewServer creates a new socks.Server.
-func NewServer(c *Config) *socks.Server {
-	return &socks.Server{
-		Rules:  createRuleSet(c),
-		Dialer: createDialer(c),
+//
+// Rules and other settings of c not loaded from a file are compiled
+// here, and an error is returned if any of them is invalid.
+func NewServer(c *Config) (*socks.Server, error) {
+	rules, err := createRuleSet(c)
+	if err != nil {
+		return nil, err
+	}
+	d, err := createDialer(c)
+	if err != nil {
+		return nil, err
+	}
+	bl, err := c.DestDNSBL.dnsblChecker()
+	if err != nil {
+		return nil, err
+	}
+	s := &socks.Server{
+		Rules:              rules,
+		Dialer:             d,
+		Resolver:           resolver{c, bl},
+		NegotiationTimeout: c.Incoming.NegotiationTimeout.Duration,
+		RelayBufferSize:    c.Incoming.RelayBufferSize,
+		SniffTransparent:   c.Transparent.Sniff,
+		DetailedMetrics:    c.Metrics.Detailed,
+		MaxLabelValues:     c.Metrics.MaxLabelValues,
+	}
+	if c.Outgoing.Sniff {
+		s.Middlewares = append(s.Middlewares, sniffer{c})
 	}
+	return s, nil
 }
 
 // NewMetricsServer creates a new metrics.Server.
-func NewMetricsServer(_ *Config) *metrics.Server {
-	return &metrics.Server{}
+//
+// The readiness of the server reflects s and lns.  lns should be
+// the listeners wrapped by TrackListeners and served by s.
+func NewMetricsServer(c *Config, s *socks.Server, lns []net.Listener) *metrics.Server {
+	checks := map[string]metrics.CheckFunc{
+		"listeners": checkListeners(lns),
+	}
+	if len(c.Feeds) > 0 {
+		checks["feeds"] = checkFeeds(c)
+	}
+	if len(c.Metrics.ResolverCheck) > 0 {
+		checks["resolver"] = checkResolver(c.Metrics.ResolverCheck)
+	}
+	if d, ok := s.Dialer.(dialer); ok {
+		checks["outgoing_addresses"] = d.Check
+	}
+	ms := &metrics.Server{
+		ReadinessChecks: checks,
+	}
+	if c.Debug.Enabled {
+		ms.EnablePprof = true
+		ms.DebugHandlers = map[string]http.Handler{
+			"sessions": sessionsHandler(s),
+		}
+		ms.DebugAllowFrom = c.Debug.allowSubnets
+		ms.DebugToken = c.Debug.Token
+	}
+	return ms
+}
+
+// sessionsHandler dumps active sessions of s in JSON.
+func sessionsHandler(s *socks.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(s.Sessions())
+	})
 }
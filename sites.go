@@ -0,0 +1,273 @@
+package usocksd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cybozu-go/log"
+)
+
+// suffixNode is a node of a trie keyed by domain labels from the end.
+type suffixNode struct {
+	children map[string]*suffixNode
+
+	// sub is true if subdomains of the name of this node match.
+	sub bool
+}
+
+func (n *suffixNode) add(labels []string) {
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*suffixNode)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = new(suffixNode)
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	n.sub = true
+}
+
+func (n *suffixNode) match(labels []string) bool {
+	for i := len(labels) - 1; i > 0; i-- {
+		n = n.children[labels[i]]
+		if n == nil {
+			return false
+		}
+		if n.sub {
+			return true
+		}
+	}
+	return false
+}
+
+// siteMatcher matches FQDN against a list of patterns.
+//
+// A pattern is one of:
+//   - an exact name such as "www.example.com",
+//   - a name beginning with a dot such as ".example.com" that matches
+//     subdomains of the name,
+//   - a glob pattern such as "ads*.example.com" (see path.Match), or
+//   - a regular expression enclosed in slashes such as "/^ad[0-9]+\./".
+//
+// All patterns are case-insensitive.
+// Exact names and subdomain patterns are looked up in constant time
+// regardless of the number of patterns.
+type siteMatcher struct {
+	exact    map[string]struct{}
+	suffixes suffixNode
+	globs    []string
+	regexps  []*regexp.Regexp
+	size     int
+}
+
+func newSiteMatcher() *siteMatcher {
+	return &siteMatcher{
+		exact: make(map[string]struct{}),
+	}
+}
+
+func (m *siteMatcher) add(pattern string) error {
+	switch {
+	case len(pattern) >= 2 && pattern[0] == '/' && pattern[len(pattern)-1] == '/':
+		re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return fmt.Errorf("invalid site pattern %s: %w", pattern, err)
+		}
+		m.regexps = append(m.regexps, re)
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid site pattern %s: %w", pattern, err)
+		}
+		m.globs = append(m.globs, strings.ToLower(pattern))
+	case len(pattern) > 1 && pattern[0] == '.':
+		m.suffixes.add(strings.Split(strings.ToLower(pattern[1:]), "."))
+	default:
+		m.exact[strings.ToLower(pattern)] = struct{}{}
+	}
+	m.size++
+	return nil
+}
+
+// empty returns true if m has no patterns.
+func (m *siteMatcher) empty() bool {
+	return m.size == 0
+}
+
+// match tests if site matches any of the patterns.
+// site should be in lower case.
+func (m *siteMatcher) match(site string) bool {
+	if _, ok := m.exact[site]; ok {
+		return true
+	}
+	if len(site) > 0 && m.suffixes.match(strings.Split(site, ".")) {
+		return true
+	}
+	for _, g := range m.globs {
+		if ok, _ := path.Match(g, site); ok {
+			return true
+		}
+	}
+	for _, re := range m.regexps {
+		if re.MatchString(site) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadFile adds patterns in a file to m.
+//
+// Each line has a pattern.  Empty lines and lines beginning with '#'
+// are ignored.  Lines in hosts file format such as "0.0.0.0 example.com"
+// are also accepted; names following the address are added as exact
+// names.
+func (m *siteMatcher) loadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if line[0] != '/' {
+			if idx := strings.IndexByte(line, '#'); idx != -1 {
+				line = line[:idx]
+			}
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 1 || line[0] == '/' {
+			if err := m.add(line); err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, lineno, err)
+			}
+			continue
+		}
+
+		if net.ParseIP(fields[0]) == nil {
+			return fmt.Errorf("%s:%d: invalid line", filename, lineno)
+		}
+		for _, name := range fields[1:] {
+			if name == "localhost" || net.ParseIP(name) != nil {
+				continue
+			}
+			if err := m.add(name); err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, lineno, err)
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// siteRules is a compiled set of allow_sites and deny_sites.
+type siteRules struct {
+	allow *siteMatcher
+	deny  *siteMatcher
+}
+
+// loadSites compiles site patterns in oc and files.
+func (oc *OutgoingConfig) loadSites() (*siteRules, error) {
+	sr := &siteRules{
+		allow: newSiteMatcher(),
+		deny:  newSiteMatcher(),
+	}
+	for _, p := range oc.AllowSites {
+		if err := sr.allow.add(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range oc.DenySites {
+		if err := sr.deny.add(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, fn := range oc.AllowSitesFiles {
+		if err := sr.allow.loadFile(fn); err != nil {
+			return nil, err
+		}
+	}
+	for _, fn := range oc.DenySitesFiles {
+		if err := sr.deny.loadFile(fn); err != nil {
+			return nil, err
+		}
+	}
+	return sr, nil
+}
+
+// compileSites compiles site patterns and files of oc if they are
+// not compiled yet.
+func (oc *OutgoingConfig) compileSites() error {
+	if oc.sites != nil {
+		return nil
+	}
+	sr, err := oc.loadSites()
+	if err != nil {
+		return err
+	}
+	oc.sites = new(atomic.Pointer[siteRules])
+	oc.sites.Store(sr)
+	return nil
+}
+
+// siteRules returns the compiled site rules.
+// Config must be loaded or compiled by compileRules beforehand.
+func (c *Config) siteRules() *siteRules {
+	return c.Outgoing.sites.Load()
+}
+
+// WatchSites reloads files of allow_sites_files and deny_sites_files
+// periodically at sites_reload_interval until ctx is canceled.
+//
+// If the interval is zero or there are no files, this returns
+// immediately.  If reloading fails, the previous lists are kept.
+func WatchSites(ctx context.Context, c *Config) error {
+	oc := &c.Outgoing
+	interval := oc.SitesReloadInterval.Duration
+	if interval == 0 || (len(oc.AllowSitesFiles) == 0 && len(oc.DenySitesFiles) == 0) {
+		return nil
+	}
+	if oc.sites == nil {
+		return errors.New("config is not loaded")
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		sr, err := oc.loadSites()
+		if err != nil {
+			_ = log.Error("failed to reload site lists", map[string]interface{}{
+				log.FnError: err.Error(),
+			})
+			continue
+		}
+		oc.sites.Store(sr)
+		_ = log.Info("reloaded site lists", map[string]interface{}{
+			"allow_sites": sr.allow.size,
+			"deny_sites":  sr.deny.size,
+		})
+	}
+}
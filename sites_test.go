@@ -0,0 +1,112 @@
+package usocksd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSiteMatcher(t *testing.T) {
+	t.Parallel()
+
+	m := newSiteMatcher()
+	for _, p := range []string{"www.amazon.com", ".Google.com", "ads*.example.com", "/^ad[0-9]+\\.example\\.org$/", "/^Tracker\\./", ""} {
+		if err := m.add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		site  string
+		match bool
+	}{
+		{"www.amazon.com", true},
+		{"amazon.com", false},
+		{"www.google.com", true},
+		{"a.b.google.com", true},
+		{"google.com", false},
+		{"notgoogle.com", false},
+		{"ads1.example.com", true},
+		{"www.example.com", false},
+		{"ad42.example.org", true},
+		{"bad42.example.org", false},
+		{"tracker.example.net", true},
+		{"", true},
+	}
+	for _, tc := range testCases {
+		if m.match(tc.site) != tc.match {
+			t.Errorf("%q: match should be %v", tc.site, tc.match)
+		}
+	}
+
+	for _, p := range []string{"[a-", "/(/"} {
+		if err := newSiteMatcher().add(p); err == nil {
+			t.Errorf("%q should be invalid", p)
+		}
+	}
+}
+
+func TestSiteMatcherLarge(t *testing.T) {
+	t.Parallel()
+
+	m := newSiteMatcher()
+	for i := 0; i < 100000; i++ {
+		if err := m.add(fmt.Sprintf(".host%d.example.com", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !m.match("www.host99999.example.com") {
+		t.Error("www.host99999.example.com should match")
+	}
+	if m.match("www.host100000.example.com") {
+		t.Error("www.host100000.example.com should not match")
+	}
+}
+
+func TestWatchSites(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	sites := filepath.Join(dir, "sites.txt")
+	if err := os.WriteFile(sites, []byte("a.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "usocksd.toml")
+	data := fmt.Sprintf("[outgoing]\ndeny_sites_files = [%q]\nsites_reload_interval = \"10ms\"\n", sites)
+	if err := os.WriteFile(conf, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConfig()
+	if err := c.Load(conf); err != nil {
+		t.Fatal(err)
+	}
+	if c.allowFQDN("a.example.com") {
+		t.Error("a.example.com should be denied")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- WatchSites(ctx, c)
+	}()
+
+	if err := os.WriteFile(sites, []byte("b.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	if !c.allowFQDN("a.example.com") {
+		t.Error("a.example.com should be allowed after reload")
+	}
+	if c.allowFQDN("b.example.com") {
+		t.Error("b.example.com should be denied after reload")
+	}
+}
@@ -0,0 +1,52 @@
+package usocksd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+const (
+	sniffTimeout = 3 * time.Second
+)
+
+// sniffer is a socks.StreamMiddleware to apply access rules to the
+// server name sent by the client in TLS SNI or HTTP Host header.
+type sniffer struct {
+	*Config
+}
+
+func (sn sniffer) Wrap(r *socks.Request, client, dest net.Conn) (net.Conn, net.Conn, error) {
+	name, client, err := socks.PeekServerName(client, sniffTimeout)
+	if err == socks.ErrNoServerName {
+		return client, dest, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	r.AddLogField("sni", name)
+
+	// a fully qualified name may end with a dot.
+	name = strings.TrimSuffix(name, ".")
+	reason := sn.decide(r.Context(), name, r.Port, time.Now()).DenyReason
+	if len(reason) == 0 && len(r.Hostname) > 0 &&
+		!strings.EqualFold(strings.TrimSuffix(r.Hostname, "."), name) {
+		reason = "sni_mismatch"
+	}
+	if len(reason) == 0 {
+		return client, dest, nil
+	}
+
+	r.DenyReason = reason
+	_ = log.Warn("denied access", map[string]interface{}{
+		"client_addr": r.Conn.RemoteAddr().String(),
+		"fqdn":        r.Hostname,
+		"sni":         name,
+		"deny_reason": reason,
+	})
+	return nil, nil, fmt.Errorf("%w: %s by %s", socks.ErrDenied, name, reason)
+}
@@ -0,0 +1,69 @@
+package usocksd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+func TestSniffer(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Outgoing.DenySites = []string{".bad.com"}
+	c.Rules = []RuleConfig{
+		{Name: "no-ads", Action: ActionDeny, Sites: []string{".ads.com"}, Ports: []PortRange{{443, 443}}},
+	}
+	if err := c.compileRules(); err != nil {
+		t.Fatal(err)
+	}
+	sn := sniffer{c}
+
+	testCases := []struct {
+		hostname string
+		data     string
+		reason   string
+	}{
+		{"", "GET / HTTP/1.1\r\nHost: www.ads.com\r\n\r\n", "rule:no-ads"},
+		{"www.good.com", "GET / HTTP/1.1\r\nHost: www.good.com\r\n\r\n", ""},
+		{"www.good.com.", "GET / HTTP/1.1\r\nHost: WWW.good.com\r\n\r\n", ""},
+		{"", "GET / HTTP/1.1\r\nHost: www.good.com\r\n\r\n", ""},
+		{"", "GET / HTTP/1.1\r\nHost: www.bad.com\r\n\r\n", "deny_sites"},
+		{"", "GET / HTTP/1.1\r\nHost: www.bad.com.\r\n\r\n", "deny_sites"},
+		{"www.good.com", "GET / HTTP/1.1\r\nHost: www.good.com.\r\n\r\n", ""},
+		{"www.good.com", "GET / HTTP/1.1\r\nHost: www.other.com\r\n\r\n", "sni_mismatch"},
+		{"www.good.com", "SSH-2.0-OpenSSH_9.0\r\n", ""},
+	}
+
+	for _, tc := range testCases {
+		c1, c2 := net.Pipe()
+		go func(data string) {
+			_, _ = c1.Write([]byte(data))
+		}(tc.data)
+
+		r := &socks.Request{
+			Hostname: tc.hostname,
+			Port:     443,
+			Conn:     c2,
+		}
+		r.SetContext(context.Background())
+		_, _, err := sn.Wrap(r, c2, nil)
+		if len(tc.reason) == 0 {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", tc.data, err)
+			}
+		} else {
+			if !errors.Is(err, socks.ErrDenied) {
+				t.Errorf("%q: should be denied: %v", tc.data, err)
+			}
+			if r.DenyReason != tc.reason {
+				t.Errorf("%q: %q != %q", tc.data, r.DenyReason, tc.reason)
+			}
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
@@ -0,0 +1,271 @@
+package usocksd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultKeepAlive      = 3 * time.Minute
+
+	// fastOpenQueueLength is the maximum number of pending TCP Fast
+	// Open requests of a listener.
+	fastOpenQueueLength = 256
+)
+
+// SocketConfig is a set of TCP socket options.
+//
+// KeepAlive is the idle time before the first keep-alive probe, and
+// KeepAliveInterval is the interval between probes.  Both default to
+// 3 minutes.  A negative KeepAlive disables keep-alive.
+// KeepAliveCount is the number of unanswered probes before the
+// connection is dropped; zero leaves the system default.
+//
+// UserTimeout sets TCP_USER_TIMEOUT.  NoDelay sets TCP_NODELAY and
+// defaults to true.  SendBuffer and RecvBuffer set SO_SNDBUF and
+// SO_RCVBUF in bytes.  FastOpen enables TCP Fast Open of listeners,
+// and MPTCP enables Multipath TCP if the kernel supports it.
+//
+// FastOpen is not supported for outgoing connections, because
+// TCP_FASTOPEN_CONNECT defers the handshake until the first write and
+// stalls destinations that speak first such as SMTP or SSH.
+//
+// ConnectTimeout applies only to outgoing connections.  It limits
+// attempts to connect to all addresses of a destination, and
+// defaults to 10 seconds.
+type SocketConfig struct {
+	ConnectTimeout    Duration `toml:"connect_timeout"`
+	KeepAlive         Duration `toml:"keepalive"`
+	KeepAliveInterval Duration `toml:"keepalive_interval"`
+	KeepAliveCount    int      `toml:"keepalive_count"`
+	UserTimeout       Duration `toml:"user_timeout"`
+	NoDelay           *bool    `toml:"nodelay"`
+	SendBuffer        int      `toml:"send_buffer"`
+	RecvBuffer        int      `toml:"recv_buffer"`
+	FastOpen          bool     `toml:"fast_open"`
+	MPTCP             bool     `toml:"mptcp"`
+}
+
+func (sc *SocketConfig) validate(section string) error {
+	switch {
+	case sc.ConnectTimeout.Duration < 0:
+		return errors.New(section + ": connect_timeout must not be negative")
+	case sc.KeepAliveInterval.Duration < 0:
+		return errors.New(section + ": keepalive_interval must not be negative")
+	case sc.KeepAliveCount < 0:
+		return errors.New(section + ": keepalive_count must not be negative")
+	case sc.UserTimeout.Duration < 0:
+		return errors.New(section + ": user_timeout must not be negative")
+	case sc.SendBuffer < 0:
+		return errors.New(section + ": send_buffer must not be negative")
+	case sc.RecvBuffer < 0:
+		return errors.New(section + ": recv_buffer must not be negative")
+	}
+	return nil
+}
+
+func (sc *SocketConfig) connectTimeout() time.Duration {
+	if sc != nil && sc.ConnectTimeout.Duration > 0 {
+		return sc.ConnectTimeout.Duration
+	}
+	return defaultConnectTimeout
+}
+
+func (sc *SocketConfig) noDelay() bool {
+	return sc == nil || sc.NoDelay == nil || *sc.NoDelay
+}
+
+// seconds rounds d up to seconds for socket options.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// setOptions sets keep-alive, user timeout, and buffer sizes of fd.
+// sc may be nil to set the defaults.
+func (sc *SocketConfig) setOptions(fd int) error {
+	if sc == nil {
+		sc = &SocketConfig{}
+	}
+
+	idle := sc.KeepAlive.Duration
+	if idle < 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 0); err != nil {
+			return fmt.Errorf("failed to disable keep-alive: %w", err)
+		}
+	} else {
+		if idle == 0 {
+			idle = defaultKeepAlive
+		}
+		interval := sc.KeepAliveInterval.Duration
+		if interval == 0 {
+			interval = defaultKeepAlive
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+			return fmt.Errorf("failed to enable keep-alive: %w", err)
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, seconds(idle)); err != nil {
+			return fmt.Errorf("failed to set TCP_KEEPIDLE: %w", err)
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, seconds(interval)); err != nil {
+			return fmt.Errorf("failed to set TCP_KEEPINTVL: %w", err)
+		}
+		if sc.KeepAliveCount > 0 {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, sc.KeepAliveCount); err != nil {
+				return fmt.Errorf("failed to set TCP_KEEPCNT: %w", err)
+			}
+		}
+	}
+
+	if ut := sc.UserTimeout.Duration; ut > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(ut/time.Millisecond)); err != nil {
+			return fmt.Errorf("failed to set TCP_USER_TIMEOUT: %w", err)
+		}
+	}
+	return sc.setBuffers(fd)
+}
+
+func (sc *SocketConfig) setBuffers(fd int) error {
+	if sc.SendBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, sc.SendBuffer); err != nil {
+			return fmt.Errorf("failed to set SO_SNDBUF: %w", err)
+		}
+	}
+	if sc.RecvBuffer > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, sc.RecvBuffer); err != nil {
+			return fmt.Errorf("failed to set SO_RCVBUF: %w", err)
+		}
+	}
+	return nil
+}
+
+// rawControl calls fn with the file descriptor of c.
+func rawControl(c syscall.RawConn, fn func(fd int) error) error {
+	var err error
+	callErr := c.Control(func(fd uintptr) {
+		err = fn(int(fd))
+	})
+	if callErr != nil {
+		return callErr
+	}
+	return err
+}
+
+// dialControl sets socket options before connecting.
+func (sc *SocketConfig) dialControl(network, address string, c syscall.RawConn) error {
+	return rawControl(c, func(fd int) error {
+		return sc.setOptions(fd)
+	})
+}
+
+// newDialer returns a net.Dialer with the socket options.
+// Keep-alive of net.Dialer is disabled so that it does not override
+// the options set by dialControl.  control may be nil.
+func (sc *SocketConfig) newDialer(control controlFn) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   sc.connectTimeout(),
+		KeepAlive: -1,
+		Control:   chainControl(sc.dialControl, control),
+	}
+	if sc != nil && sc.MPTCP {
+		d.SetMultipathTCP(true)
+	}
+	return d
+}
+
+// setNoDelay sets TCP_NODELAY of a connected conn, as net package
+// always enables it after connect and accept.
+func (sc *SocketConfig) setNoDelay(conn net.Conn) error {
+	if sc.noDelay() {
+		return nil
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		return tc.SetNoDelay(false)
+	}
+	return nil
+}
+
+// setConn sets socket options of an accepted conn.
+func (sc *SocketConfig) setConn(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if err := rawControl(raw, sc.setOptions); err != nil {
+		return err
+	}
+	return sc.setNoDelay(conn)
+}
+
+// socketListener sets socket options of accepted connections, as
+// well.Server cannot enable keep-alive for wrapped listeners.
+// File of *net.TCPListener is promoted for well.Graceful.
+type socketListener struct {
+	*net.TCPListener
+	socket *SocketConfig
+}
+
+func (l socketListener) Accept() (net.Conn, error) {
+	conn, err := l.TCPListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.socket.setConn(conn); err != nil {
+		_ = log.Warn("failed to set socket options", map[string]interface{}{
+			"client_addr": conn.RemoteAddr().String(),
+			log.FnError:   err.Error(),
+		})
+	}
+	return conn, nil
+}
+
+// SocketListeners wraps TCP listeners so that accepted connections
+// are configured with incoming socket options of c.
+//
+// Listeners returns wrapped listeners.  Listeners restored from files
+// in child processes of well.Graceful need to be wrapped by this.
+func SocketListeners(c *Config, lns []net.Listener) []net.Listener {
+	slns := make([]net.Listener, len(lns))
+	for i, ln := range lns {
+		slns[i] = ln
+		if tl, ok := ln.(*net.TCPListener); ok {
+			slns[i] = socketListener{TCPListener: tl, socket: &c.Incoming.Socket}
+		}
+	}
+	return slns
+}
+
+// listenConfig returns a net.ListenConfig to enable TCP Fast Open and
+// MPTCP on listeners.  Buffer sizes are set on listeners so that
+// accepted connections inherit them before the handshake.
+func (sc *SocketConfig) listenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return rawControl(c, func(fd int) error {
+				if err := sc.setBuffers(fd); err != nil {
+					return err
+				}
+				if sc.FastOpen {
+					if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueueLength); err != nil {
+						return fmt.Errorf("failed to set TCP_FASTOPEN: %w", err)
+					}
+				}
+				return nil
+			})
+		},
+	}
+	if sc.MPTCP {
+		lc.SetMultipathTCP(true)
+	}
+	return lc
+}
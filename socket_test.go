@@ -0,0 +1,274 @@
+package usocksd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type sockopt struct {
+	level, opt int
+}
+
+func getsockopts(t *testing.T, conn net.Conn, opts []sockopt) []int {
+	t.Helper()
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]int, len(opts))
+	var optErr error
+	err = rc.Control(func(fd uintptr) {
+		for i, o := range opts {
+			values[i], optErr = unix.GetsockoptInt(int(fd), o.level, o.opt)
+			if optErr != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return values
+}
+
+var testSockopts = []sockopt{
+	{unix.SOL_SOCKET, unix.SO_KEEPALIVE},
+	{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE},
+	{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL},
+	{unix.IPPROTO_TCP, unix.TCP_KEEPCNT},
+	{unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT},
+	{unix.IPPROTO_TCP, unix.TCP_NODELAY},
+}
+
+func TestSocketOptions(t *testing.T) {
+	t.Parallel()
+
+	noDelay := false
+	sc := &SocketConfig{
+		KeepAlive:         Duration{30 * time.Second},
+		KeepAliveInterval: Duration{5 * time.Second},
+		KeepAliveCount:    4,
+		UserTimeout:       Duration{20 * time.Second},
+		NoDelay:           &noDelay,
+		RecvBuffer:        64 << 10,
+	}
+	if err := sc.validate("test"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{1, 30, 5, 4, 20000, 0}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := dialTCP(context.Background(), sc, &net.TCPAddr{}, l.Addr().(*net.TCPAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	values := getsockopts(t, conn, testSockopts)
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("dialed: option %d: expected %d, got %d", i, expected[i], values[i])
+		}
+	}
+	rcvbuf := getsockopts(t, conn, []sockopt{{unix.SOL_SOCKET, unix.SO_RCVBUF}})[0]
+	if rcvbuf < 64<<10 {
+		t.Errorf("dialed: too small SO_RCVBUF: %d", rcvbuf)
+	}
+
+	aconn, ok := <-accepted
+	if !ok {
+		t.Fatal("failed to accept")
+	}
+	defer aconn.Close()
+	if err := sc.setConn(aconn); err != nil {
+		t.Fatal(err)
+	}
+	values = getsockopts(t, aconn, testSockopts)
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("accepted: option %d: expected %d, got %d", i, expected[i], values[i])
+		}
+	}
+}
+
+func TestSocketDefaults(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := dialTCP(context.Background(), nil, &net.TCPAddr{}, l.Addr().(*net.TCPAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	values := getsockopts(t, conn, testSockopts[:3])
+	if values[0] != 1 || values[1] != 180 || values[2] != 180 {
+		t.Errorf("unexpected keep-alive options: %v", values)
+	}
+	if nd := getsockopts(t, conn, testSockopts[5:])[0]; nd == 0 {
+		t.Error("TCP_NODELAY should be enabled by default")
+	}
+
+	bad := []SocketConfig{
+		{ConnectTimeout: Duration{-time.Second}},
+		{KeepAliveCount: -1},
+		{SendBuffer: -1},
+	}
+	for i := range bad {
+		if err := bad[i].validate("test"); err == nil {
+			t.Errorf("validate should fail: %+v", bad[i])
+		}
+	}
+}
+
+func TestSocketListeners(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Incoming.Socket.KeepAlive = Duration{40 * time.Second}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := SocketListeners(c, []net.Listener{ln})[0]
+	defer l.Close()
+
+	// well.Graceful passes listeners to child processes as files.
+	fl, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		t.Fatal("wrapped listener should have File method")
+	}
+	f, err := fl.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	aconn, ok := <-accepted
+	if !ok {
+		t.Fatal("failed to accept")
+	}
+	defer aconn.Close()
+	values := getsockopts(t, aconn, testSockopts[:2])
+	if values[0] != 1 || values[1] != 40 {
+		t.Error("incoming socket options should be set:", values)
+	}
+}
+
+func TestSocketListen(t *testing.T) {
+	t.Parallel()
+
+	sc := &SocketConfig{FastOpen: true, MPTCP: true}
+	l, err := sc.listenConfig().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := dialTCP(context.Background(), sc, &net.TCPAddr{}, l.Addr().(*net.TCPAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestSocketServerFirst(t *testing.T) {
+	t.Parallel()
+
+	l, err := (&SocketConfig{FastOpen: true}).listenConfig().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("220 ready\r\n"))
+			conn.Close()
+		}
+	}()
+
+	// FastOpen is ignored for outgoing connections so that
+	// destinations speaking first do not stall.
+	sc := &SocketConfig{FastOpen: true}
+	conn, err := dialTCP(context.Background(), sc, &net.TCPAddr{}, l.Addr().(*net.TCPAddr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v := getsockopts(t, conn, []sockopt{{unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT}}); v[0] != 0 {
+		t.Error("TCP_FASTOPEN_CONNECT should not be set")
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal("server greeting should be received:", err)
+	}
+	if string(buf[:n]) != "220 ready\r\n" {
+		t.Errorf("unexpected greeting: %q", buf[:n])
+	}
+
+	conf := filepath.Join(t.TempDir(), "usocksd.toml")
+	if err := os.WriteFile(conf, []byte("[outgoing.socket]\nfast_open = true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewConfig().Load(conf); err == nil {
+		t.Error("fast_open of outgoing.socket should be rejected")
+	}
+}
@@ -10,6 +10,10 @@ type version byte
 const (
 	SOCKS4 = version(0x04)
 	SOCKS5 = version(0x05)
+
+	// Transparent is the pseudo version of requests made from
+	// connections intercepted by a transparent proxy.
+	Transparent = version(0xff)
 )
 
 func (v version) String() string {
@@ -18,6 +22,8 @@ func (v version) String() string {
 		return "SOCKS4/4a"
 	case SOCKS5:
 		return "SOCKS5"
+	case Transparent:
+		return "transparent"
 	}
 	return ""
 }
@@ -33,10 +39,15 @@ func (v version) LabelValue() string {
 type commandType byte
 
 // SOCKS commands.
+//
+// CmdResolve and CmdResolvePTR are SOCKS5 extensions of Tor to
+// resolve names through the proxy without connecting.
 const (
-	CmdConnect = commandType(0x01)
-	CmdBind    = commandType(0x02)
-	CmdUDP     = commandType(0x03)
+	CmdConnect    = commandType(0x01)
+	CmdBind       = commandType(0x02)
+	CmdUDP        = commandType(0x03)
+	CmdResolve    = commandType(0xf0)
+	CmdResolvePTR = commandType(0xf1)
 )
 
 func (c commandType) String() string {
@@ -47,10 +58,22 @@ func (c commandType) String() string {
 		return "bind"
 	case CmdUDP:
 		return "UDP associate"
+	case CmdResolve:
+		return "resolve"
+	case CmdResolvePTR:
+		return "resolve PTR"
 	}
 	return ""
 }
 
+func (c commandType) LabelValue() string {
+	raw := c.String()
+	if raw == "" {
+		return UNKNOWN
+	}
+	return strings.ReplaceAll(raw, " ", "_")
+}
+
 type addressType byte
 
 // SOCKS address types.
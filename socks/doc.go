@@ -6,5 +6,8 @@ Features:
 * Username/password authentication.
 * CONNECT command (BIND and UDP ASSOCIATE is not supported).
 * Graceful stop (thanks to github.com/cybozu-go/well package).
+* Hooks to observe authentication, rules, dialing, and end of sessions.
+* Middlewares to intercept relayed streams.
+* Server name sniffing from TLS ClientHello and HTTP requests.
 */
 package socks
@@ -0,0 +1,104 @@
+package socks
+
+import (
+	"net"
+	"time"
+)
+
+// EventType identifies the kind of Event.
+type EventType int
+
+// Event types.
+//
+// For SOCKS5, EventAuth precedes EventNegotiated because authentication
+// is negotiated before the client sends the request.  For SOCKS4,
+// EventNegotiated precedes EventAuth.
+const (
+	// EventNegotiated is emitted when the request is read from the client.
+	EventNegotiated = EventType(iota + 1)
+
+	// EventAuth is emitted when authentication completes.
+	EventAuth
+
+	// EventRule is emitted when the request is tested by RuleSet.
+	EventRule
+
+	// EventDial is emitted when dialing to the destination completes.
+	EventDial
+
+	// EventSessionEnd is emitted when the connection from the client ends.
+	EventSessionEnd
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventNegotiated:
+		return "negotiated"
+	case EventAuth:
+		return "auth"
+	case EventRule:
+		return "rule"
+	case EventDial:
+		return "dial"
+	case EventSessionEnd:
+		return "session_end"
+	}
+	return ""
+}
+
+// Event describes a step of a session.
+type Event struct {
+	Type EventType
+
+	// ClientAddr is the address of the client.
+	ClientAddr net.Addr
+
+	// Request is the request from the client.
+	// This may be nil for EventSessionEnd if the request was not read.
+	Request *Request
+
+	// OK is the result of EventAuth, EventRule, and EventDial.
+	OK bool
+
+	// Conn is the connection to the destination.
+	// This is set for successful EventDial.
+	Conn net.Conn
+
+	// Result is the result of the session for EventSessionEnd.
+	// This is one of Result* constants.
+	Result string
+
+	// TxBytes and RxBytes are bytes copied to the destination and
+	// to the client, respectively.  These are set for EventSessionEnd.
+	TxBytes int64
+	RxBytes int64
+
+	// Elapsed is the duration of the session for EventSessionEnd.
+	Elapsed time.Duration
+
+	// Err is the error of failed EventDial or EventSessionEnd.
+	Err error
+}
+
+// EventHandler is the interface to observe sessions.
+//
+// HandleEvent is called synchronously from goroutines handling
+// sessions, so it should return quickly.
+type EventHandler interface {
+	HandleEvent(e *Event)
+}
+
+// EventHandlerFunc is an adapter to use a function as EventHandler.
+type EventHandlerFunc func(e *Event)
+
+// HandleEvent calls f(e).
+func (f EventHandlerFunc) HandleEvent(e *Event) {
+	f(e)
+}
+
+func (s *Server) emit(e *Event) {
+	if s.Events == nil {
+		return
+	}
+	s.Events.HandleEvent(e)
+}
@@ -0,0 +1,63 @@
+package socks
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// DefaultMaxLabelValues is the default maximum number of distinct
+	// values for each label of detailed metrics.
+	DefaultMaxLabelValues = 100
+
+	// OtherLabelValue is the label value used after the number of
+	// distinct values reaches the limit.
+	OtherLabelValue = "other"
+)
+
+// labelLimiter limits the number of distinct values of a label.
+type labelLimiter struct {
+	max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newLabelLimiter(max int) *labelLimiter {
+	return &labelLimiter{
+		max:  max,
+		seen: make(map[string]struct{}),
+	}
+}
+
+// value returns v if v has been seen or there is room for a new value.
+// Otherwise, it returns OtherLabelValue.
+func (l *labelLimiter) value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) >= l.max {
+		return OtherLabelValue
+	}
+	l.seen[v] = struct{}{}
+	return v
+}
+
+// destinationLabel returns the registrable domain of the destination
+// hostname, or the destination IP address.
+func destinationLabel(r *Request) string {
+	if len(r.Hostname) == 0 {
+		return r.IP.String()
+	}
+	hostname := strings.ToLower(r.Hostname)
+	domain, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	if err != nil {
+		return hostname
+	}
+	return domain
+}
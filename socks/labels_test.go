@@ -0,0 +1,84 @@
+package socks
+
+import (
+	"net"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestLabelLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := newLabelLimiter(2)
+	if v := l.value("a"); v != "a" {
+		t.Error(`unexpected value for "a":`, v)
+	}
+	if v := l.value("b"); v != "b" {
+		t.Error(`unexpected value for "b":`, v)
+	}
+	if v := l.value("c"); v != OtherLabelValue {
+		t.Error(`unexpected value for "c":`, v)
+	}
+	if v := l.value("a"); v != "a" {
+		t.Error(`unexpected value for "a":`, v)
+	}
+}
+
+func TestDestinationLabel(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		r        *Request
+		expected string
+	}{
+		{&Request{Hostname: "www.example.com"}, "example.com"},
+		{&Request{Hostname: "A.B.Example.CO.JP"}, "example.co.jp"},
+		{&Request{Hostname: "localhost"}, "localhost"},
+		{&Request{IP: net.ParseIP("10.1.2.3")}, "10.1.2.3"},
+	}
+	for _, tc := range testCases {
+		if v := destinationLabel(tc.r); v != tc.expected {
+			t.Errorf("unexpected label for %+v: %s", tc.r, v)
+		}
+	}
+}
+
+type localAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c localAddrConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func TestListenerLabel(t *testing.T) {
+	t.Parallel()
+
+	s := &Server{DetailedMetrics: true, MaxLabelValues: 2}
+	s.once.Do(s.init)
+	listener := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1082}
+
+	// with TPROXY, the local address is the original destination.
+	for i := 1; i <= 3; i++ {
+		r := &Request{
+			Username: "listener-label-test",
+			IP:       net.IPv4(192, 0, 2, byte(i)),
+			Conn:     localAddrConn{addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 443}},
+		}
+		s.observeSession(&session{listener: listener, request: r}, 0, 0)
+	}
+
+	var m dto.Metric
+	c := sessionCounter.WithLabelValues("listener-label-test", "127.0.0.1:1082", OtherLabelValue)
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.GetCounter().GetValue(); v != 1 {
+		t.Error("sessions should be counted by the listener address:", v)
+	}
+	if v := s.listenerLabels.value("127.0.0.1:1080"); v != "127.0.0.1:1080" {
+		t.Error("destinations should not use up listener labels:", v)
+	}
+}
@@ -60,6 +60,30 @@ var (
 		Help:      "time spent copying from destination to source",
 	})
 
+	sessionCounter = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "proxy",
+		Name:      "sessions_total",
+		Help:      "number of proxy sessions by user, listener and destination",
+	}, []string{"user", "listener", "destination"})
+
+	// Bytes of session counters are added when sessions end.
+	// proxy_tx_bytes and proxy_rx_bytes histograms own the names of
+	// OpenMetrics families "proxy_tx_bytes" and "proxy_rx_bytes".
+	sessionTxBytesCounter = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "session",
+		Name:      "tx_bytes_total",
+		Help:      "bytes copied from the source connection to the destination connection by user, listener and destination, added when sessions end",
+	}, []string{"user", "listener", "destination"})
+
+	sessionRxBytesCounter = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "session",
+		Name:      "rx_bytes_total",
+		Help:      "bytes copied from the destination connection to the source connection by user, listener and destination, added when sessions end",
+	}, []string{"user", "listener", "destination"})
+
 	authNegotiateCounter = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
 		Namespace: metrics.Namespace,
 		Subsystem: "socks5",
@@ -74,6 +98,13 @@ var (
 		Help:      "address read total count",
 	}, []string{"type", "result"})
 
+	resolveCounter = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "socks5",
+		Name:      "resolves_total",
+		Help:      "number of RESOLVE and RESOLVE_PTR requests",
+	}, []string{"command", "result"})
+
 	connectionCounter = promauto.With(metrics.Registry).NewCounterVec(prometheus.CounterOpts{
 		Namespace: metrics.Namespace,
 		Name:      "connections_total",
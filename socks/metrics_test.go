@@ -0,0 +1,94 @@
+package socks
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cybozu-go/usocksd/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// openMetricsSuffixes are suffixes of samples allowed in a family.
+var openMetricsSuffixes = []string{"", "_total", "_created", "_bucket", "_count", "_sum", "_info"}
+
+func TestOpenMetrics(t *testing.T) {
+	t.Parallel()
+
+	// vectors are exposed only after they have a child.
+	sessionCounter.WithLabelValues("openmetrics-test", "127.0.0.1:1080", "example.com").Add(0)
+	sessionTxBytesCounter.WithLabelValues("openmetrics-test", "127.0.0.1:1080", "example.com").Add(0)
+	sessionRxBytesCounter.WithLabelValues("openmetrics-test", "127.0.0.1:1080", "example.com").Add(0)
+
+	h := promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Fatal("unexpected content type:", ct)
+	}
+
+	families := make(map[string]bool)
+	var family string
+	var eof bool
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if eof {
+			t.Fatal("line after # EOF:", line)
+		}
+		switch {
+		case line == "# EOF":
+			eof = true
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				t.Fatal("malformed TYPE line:", line)
+			}
+			family = fields[2]
+			// go_memstats_alloc_bytes of the Go collector is known to conflict.
+			if families[family] && strings.HasPrefix(family, metrics.Namespace+"_") {
+				t.Error("duplicate metric family:", family)
+			}
+			families[family] = true
+		case strings.HasPrefix(line, "#"):
+		default:
+			name := line
+			if i := strings.IndexAny(line, "{ "); i >= 0 {
+				name = line[:i]
+			}
+			if !sampleOf(name, family) {
+				t.Errorf("sample %s does not belong to family %s", name, family)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !eof {
+		t.Error("no # EOF")
+	}
+
+	for _, name := range []string{
+		"usocksd_proxy_tx_bytes",
+		"usocksd_proxy_rx_bytes",
+		"usocksd_session_tx_bytes",
+		"usocksd_session_rx_bytes",
+	} {
+		if !families[name] {
+			t.Error("missing metric family:", name)
+		}
+	}
+}
+
+func sampleOf(name, family string) bool {
+	for _, suffix := range openMetricsSuffixes {
+		if name == family+suffix {
+			return true
+		}
+	}
+	return false
+}
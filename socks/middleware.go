@@ -0,0 +1,51 @@
+package socks
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrDenied can be returned by StreamMiddleware or Dialer to tell that
+// the session is denied by access rules.  It may be wrapped.
+var ErrDenied = errors.New("denied")
+
+// StreamMiddleware is the interface to intercept relayed streams.
+//
+// Wrap is called after negotiation completes and before relaying starts.
+// It may return connections wrapping client and dest to count, inspect,
+// rate-limit, record, or transform bytes.  Returning client and dest as
+// they are leaves the streams untouched.
+//
+// Data written to the returned dest is sent to the destination, and
+// data written to the returned client is sent to the client.
+// If Wrap returns an error, the session is closed.  The session is
+// recorded as ResultDenied if the error is ErrDenied.
+//
+// Returned connections should implement netutil.HalfCloser to
+// propagate half-close to the peers.  Note that a connection embedding
+// *net.TCPConn inherits its ReadFrom method, which bypasses Write.
+type StreamMiddleware interface {
+	Wrap(r *Request, client, dest net.Conn) (net.Conn, net.Conn, error)
+}
+
+// StreamMiddlewareFunc is an adapter to use a function as StreamMiddleware.
+type StreamMiddlewareFunc func(r *Request, client, dest net.Conn) (net.Conn, net.Conn, error)
+
+// Wrap calls f(r, client, dest).
+func (f StreamMiddlewareFunc) Wrap(r *Request, client, dest net.Conn) (net.Conn, net.Conn, error) {
+	return f(r, client, dest)
+}
+
+// wrapStreams applies s.Middlewares in order.
+// The first middleware wraps the raw connections, and the last one
+// is closest to the relay.
+func (s *Server) wrapStreams(r *Request, client, dest net.Conn) (net.Conn, net.Conn, error) {
+	for _, m := range s.Middlewares {
+		c, d, err := m.Wrap(r, client, dest)
+		if err != nil {
+			return nil, nil, err
+		}
+		client, dest = c, d
+	}
+	return client, dest, nil
+}
@@ -38,7 +38,12 @@ type Request struct {
 	// Conn is the connection from the client.
 	Conn net.Conn
 
-	ctx context.Context
+	// DenyReason may be set by RuleSet or Dialer to describe why the request
+	// is denied.  This is recorded in the access log.
+	DenyReason string
+
+	ctx       context.Context
+	logFields map[string]interface{}
 }
 
 // Context returns the request context.
@@ -50,3 +55,13 @@ func (r *Request) Context() context.Context {
 func (r *Request) SetContext(ctx context.Context) {
 	r.ctx = ctx
 }
+
+// AddLogField adds a field to be recorded in the access log.
+// Authenticator, RuleSet, and Dialer can use this to record
+// their decisions.
+func (r *Request) AddLogField(key string, value interface{}) {
+	if r.logFields == nil {
+		r.logFields = make(map[string]interface{})
+	}
+	r.logFields[key] = value
+}
@@ -0,0 +1,149 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/cybozu-go/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	resolveResultOk     = "ok"
+	resolveResultDenied = "denied"
+	resolveResultFailed = "failed"
+)
+
+var errNoAnswer = errors.New("no answer")
+
+// Resolver is the interface to resolve names for CmdResolve and
+// CmdResolvePTR requests.
+//
+// Resolve returns the addresses of r.Hostname, and ResolvePTR returns
+// the names of r.IP.  They may return an error wrapping ErrDenied to
+// refuse the request by access rules.
+type Resolver interface {
+	Resolve(r *Request) ([]net.IP, error)
+	ResolvePTR(r *Request) ([]string, error)
+}
+
+// defaultResolver uses net.DefaultResolver.
+type defaultResolver struct{}
+
+func (defaultResolver) Resolve(r *Request) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(r.Context(), "ip", r.Hostname)
+}
+
+func (defaultResolver) ResolvePTR(r *Request) ([]string, error) {
+	return net.DefaultResolver.LookupAddr(r.Context(), r.IP.String())
+}
+
+// lookup resolves r by s.Resolver.  It returns a request to make
+// the response.
+func (s *Server) lookup(r *Request) (*Request, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = defaultResolver{}
+	}
+
+	if r.Command == CmdResolvePTR {
+		names, err := resolver.ResolvePTR(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if len(name) > 0 && len(name) < 256 {
+				return &Request{Hostname: name}, nil
+			}
+		}
+		return nil, errNoAnswer
+	}
+
+	if len(r.Hostname) == 0 {
+		return &Request{IP: r.IP}, nil
+	}
+	ips, err := resolver.Resolve(r)
+	if err != nil {
+		return nil, err
+	}
+	// IPv4 addresses are preferred as Tor does.
+	var answer net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			answer = ip
+			break
+		}
+		if answer == nil {
+			answer = ip
+		}
+	}
+	if answer == nil {
+		return nil, errNoAnswer
+	}
+	return &Request{IP: answer}, nil
+}
+
+// resolve answers a CmdResolve or CmdResolvePTR request of sess.
+func (s *Server) resolve(ctx context.Context, sess *session, fields map[string]interface{}) {
+	r := sess.request
+	rctx, span := Tracer().Start(ctx, "socks.resolve", trace.WithAttributes(requestAttributes(r)...))
+
+	// let the resolver create child spans of socks.resolve.
+	orig := r.ctx
+	r.ctx = rctx
+	answer, err := s.lookup(r)
+	r.ctx = orig
+
+	var response []byte
+	result := resolveResultOk
+	switch {
+	case err == nil:
+		response = makeSOCKS5Response(answer)
+		response[1] = byte(Status5Granted)
+		resolved := answer.Hostname
+		if len(resolved) == 0 {
+			resolved = answer.IP.String()
+		}
+		r.AddLogField("resolved", resolved)
+		fields["resolved"] = resolved
+		span.SetAttributes(attribute.String("socks.resolved", resolved))
+	case errors.Is(err, ErrDenied):
+		response = makeSOCKS5Response(r)
+		response[1] = byte(Status5DeniedByRuleset)
+		result = resolveResultDenied
+		sess.fail(ResultDenied, err)
+	default:
+		response = makeSOCKS5Response(r)
+		response[1] = byte(Status5HostUnreachable)
+		result = resolveResultFailed
+		sess.fail(ResultError, err)
+	}
+	endSpan(span, err)
+
+	status := socks5ResponseStatus(response[1])
+	connectionCounter.WithLabelValues(SOCKS5.LabelValue(), status.LabelValue()).Inc()
+	resolveCounter.WithLabelValues(r.Command.LabelValue(), result).Inc()
+
+	if _, werr := sess.conn.Write(response); err == nil && werr != nil {
+		err = werr
+		sess.fail(ResultError, err)
+	}
+	if err != nil {
+		fields[log.FnError] = err.Error()
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, "resolve failed")
+		_ = s.Logger.Error("resolve failed", fields)
+		return
+	}
+
+	sess.result = ResultSuccess
+	if s.SilenceLogs {
+		_ = s.Logger.Debug("resolved", fields)
+	} else {
+		_ = s.Logger.Info("resolved", fields)
+	}
+}
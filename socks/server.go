@@ -2,6 +2,7 @@ package socks
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -11,15 +12,23 @@ import (
 	"github.com/cybozu-go/log"
 	"github.com/cybozu-go/netutil"
 	"github.com/cybozu-go/well"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	copyBufferSize     = 64 << 10
-	negotiationTimeout = 10 * time.Second
+	// DefaultNegotiationTimeout is the default maximum duration to
+	// negotiate with a client and to connect to the destination.
+	DefaultNegotiationTimeout = 10 * time.Second
+
+	// DefaultRelayBufferSize is the default size of buffers to relay data.
+	DefaultRelayBufferSize = 64 << 10
 )
 
 var (
 	dialer = &net.Dialer{
+		KeepAlive: 3 * time.Minute,
 		DualStack: true,
 	}
 )
@@ -41,6 +50,12 @@ type RuleSet interface {
 }
 
 // Dialer is the interface to establish connection to the destination.
+//
+// Dial may return an error wrapping ErrDenied to refuse the request
+// by access rules.  Such requests are recorded as ResultDenied.
+//
+// Dial is responsible for socket options of the connection such as
+// TCP keep-alive.
 type Dialer interface {
 	Dial(r *Request) (net.Conn, error)
 }
@@ -59,6 +74,22 @@ type Server struct {
 	// If nil, net.DialContext is used.
 	Dialer Dialer
 
+	// Resolver is used to answer RESOLVE and RESOLVE_PTR requests.
+	// If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// NegotiationTimeout is the maximum duration to negotiate with
+	// a client.  It also limits connecting to the destination if
+	// Dialer is nil.
+	//
+	// Zero means DefaultNegotiationTimeout.
+	NegotiationTimeout time.Duration
+
+	// RelayBufferSize is the size of buffers to relay data.
+	//
+	// Zero means DefaultRelayBufferSize.
+	RelayBufferSize int
+
 	// Logger can be used to provide a custom logger.
 	// If nil, the default logger is used.
 	Logger *log.Logger
@@ -77,23 +108,91 @@ type Server struct {
 	// SilenceLogs changes Info-level logs to Debug-level ones.
 	SilenceLogs bool
 
-	once   sync.Once
-	server well.Server
-	pool   *sync.Pool
+	// SniffTransparent, if true, sets Hostname of requests from
+	// connections served by ServeTransparent to the server name sent
+	// by the client in TLS SNI or HTTP Host header.  The destination
+	// is then connected by the name instead of the original address.
+	SniffTransparent bool
+
+	// AccessLog, if not nil, is used to record an access log for
+	// each connection from clients.
+	AccessLog *log.Logger
+
+	// Events, if not nil, receives events of sessions.
+	Events EventHandler
+
+	// Middlewares are applied in order to connections of each session
+	// before relaying data.
+	//
+	// If empty, data are relayed between raw connections so that
+	// zero-copy such as splice(2) can be used.
+	Middlewares []StreamMiddleware
+
+	// DetailedMetrics enables metrics labeled by user, listener,
+	// and destination.
+	DetailedMetrics bool
+
+	// MaxLabelValues is the maximum number of distinct values for
+	// each label of detailed metrics.  Sessions with other values are
+	// accounted as OtherLabelValue.
+	//
+	// Zero means DefaultMaxLabelValues.
+	MaxLabelValues int
+
+	// DestinationLabel can be used to provide the destination label
+	// value of detailed metrics.
+	// If nil, the registrable domain of the destination is used.
+	DestinationLabel func(r *Request) string
+
+	once     sync.Once
+	pool     *sync.Pool
+	sessions sync.Map
+
+	userLabels        *labelLimiter
+	listenerLabels    *labelLimiter
+	destinationLabels *labelLimiter
 }
 
 func (s *Server) init() {
 	if s.Logger == nil {
 		s.Logger = log.DefaultLogger()
 	}
-	s.server.ShutdownTimeout = s.ShutdownTimeout
-	s.server.Env = s.Env
-	s.server.Handler = s.handleConnection
+	if s.NegotiationTimeout == 0 {
+		s.NegotiationTimeout = DefaultNegotiationTimeout
+	}
+	if s.RelayBufferSize == 0 {
+		s.RelayBufferSize = DefaultRelayBufferSize
+	}
+	bufSize := s.RelayBufferSize
 	s.pool = &sync.Pool{
 		New: func() interface{} {
-			return make([]byte, copyBufferSize)
+			return make([]byte, bufSize)
 		},
 	}
+	if s.MaxLabelValues == 0 {
+		s.MaxLabelValues = DefaultMaxLabelValues
+	}
+	if s.DestinationLabel == nil {
+		s.DestinationLabel = destinationLabel
+	}
+	s.userLabels = newLabelLimiter(s.MaxLabelValues)
+	s.listenerLabels = newLabelLimiter(s.MaxLabelValues)
+	s.destinationLabels = newLabelLimiter(s.MaxLabelValues)
+}
+
+// observeSession updates detailed metrics for a finished session.
+func (s *Server) observeSession(sess *session, tx, rx int64) {
+	if !s.DetailedMetrics {
+		return
+	}
+	r := sess.request
+	user := s.userLabels.value(r.Username)
+	// LocalAddr of connections is not the listener address with TPROXY.
+	listener := s.listenerLabels.value(sess.listener.String())
+	destination := s.destinationLabels.value(s.DestinationLabel(r))
+	sessionCounter.WithLabelValues(user, listener, destination).Inc()
+	sessionTxBytesCounter.WithLabelValues(user, listener, destination).Add(float64(tx))
+	sessionRxBytesCounter.WithLabelValues(user, listener, destination).Add(float64(rx))
 }
 
 // Serve starts a goroutine to accept connections.
@@ -101,11 +200,78 @@ func (s *Server) init() {
 // See https://godoc.org/github.com/cybozu-go/well#Server.Serve
 func (s *Server) Serve(l net.Listener) {
 	s.once.Do(s.init)
-	s.server.Serve(l)
+	s.serve(l, s.handleConnection)
 }
 
+// serve accepts connections from l and handles them with the address
+// of l.
+func (s *Server) serve(l net.Listener, handler func(ctx context.Context, conn net.Conn, listener net.Addr)) {
+	addr := l.Addr()
+	ws := &well.Server{
+		ShutdownTimeout: s.ShutdownTimeout,
+		Env:             s.Env,
+		Handler: func(ctx context.Context, conn net.Conn) {
+			handler(ctx, conn, addr)
+		},
+	}
+	ws.Serve(l)
+}
+
+// matchRules tests r with s.Rules.
+func (s *Server) matchRules(r *Request) bool {
+	if s.Rules == nil {
+		s.emit(&Event{
+			Type:       EventRule,
+			ClientAddr: r.Conn.RemoteAddr(),
+			Request:    r,
+			OK:         true,
+		})
+		return true
+	}
+	_, span := Tracer().Start(r.ctx, "socks.rules", trace.WithAttributes(requestAttributes(r)...))
+	defer span.End()
+	ok := s.Rules.Match(r)
+	span.SetAttributes(attribute.Bool("socks.allowed", ok))
+	s.emit(&Event{
+		Type:       EventRule,
+		ClientAddr: r.Conn.RemoteAddr(),
+		Request:    r,
+		OK:         ok,
+	})
+	return ok
+}
+
+// dial connects to the destination.  ctx should be r.Context() so
+// that values set by RuleSet are passed to Dialer.
 func (s *Server) dial(ctx context.Context, r *Request, network string) (net.Conn, error) {
+	ctx, span := Tracer().Start(ctx, "socks.dial", trace.WithAttributes(requestAttributes(r)...))
+	conn, err := s.doDial(ctx, r, network)
+	if err == nil {
+		span.SetAttributes(
+			attribute.String("destination.address", conn.RemoteAddr().String()),
+			attribute.String("source.address", conn.LocalAddr().String()),
+		)
+	}
+	endSpan(span, err)
+	s.emit(&Event{
+		Type:       EventDial,
+		ClientAddr: r.Conn.RemoteAddr(),
+		Request:    r,
+		OK:         err == nil,
+		Conn:       conn,
+		Err:        err,
+	})
+	return conn, err
+}
+
+func (s *Server) doDial(ctx context.Context, r *Request, network string) (net.Conn, error) {
 	if s.Dialer != nil {
+		// let the dialer create child spans of socks.dial.
+		orig := r.ctx
+		r.ctx = ctx
+		defer func() {
+			r.ctx = orig
+		}()
 		return s.Dialer.Dial(r)
 	}
 
@@ -116,70 +282,122 @@ func (s *Server) dial(ctx context.Context, r *Request, network string) (net.Conn
 		addr = net.JoinHostPort(r.Hostname, strconv.Itoa(r.Port))
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, negotiationTimeout)
+	ctx, cancel := context.WithTimeout(ctx, s.NegotiationTimeout)
 	defer cancel()
 	return dialer.DialContext(ctx, network, addr)
 }
 
 // handleConnection implements SOCKS protocol.
-func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
-	_ = conn.SetDeadline(time.Now().Add(negotiationTimeout))
-
-	var (
-		preamble [2]byte
-		socksVer version
+func (s *Server) handleConnection(ctx context.Context, conn net.Conn, listener net.Addr) {
+	ctx, span := Tracer().Start(ctx, "socks.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("client.address", conn.RemoteAddr().String())),
 	)
+	defer span.End()
+
+	_ = conn.SetDeadline(time.Now().Add(s.NegotiationTimeout))
+
+	sess := &session{
+		conn:     conn,
+		listener: listener,
+		startAt:  time.Now(),
+	}
+	defer s.endSession(ctx, sess)
+
+	var preamble [2]byte
 	_, err := io.ReadFull(conn, preamble[:])
 	if err != nil {
-		fields := well.FieldsFromContext(ctx)
+		fields := fieldsFromContext(ctx)
 		fields["client_addr"] = conn.RemoteAddr().String()
 		fields[log.FnError] = err.Error()
+		span.SetStatus(codes.Error, "failed to read preamble")
 		_ = s.Logger.Error("failed to read preamble", fields)
-		connectionCounter.WithLabelValues(socksVer.LabelValue(), "invalid_request").Inc()
+		sess.fail(ResultInvalid, err)
+		connectionCounter.WithLabelValues(sess.version.LabelValue(), "invalid_request").Inc()
 		return
 	}
 
-	connVer := version(preamble[0])
 	var destConn net.Conn
-	switch connVer {
+	switch version(preamble[0]) {
 	case SOCKS4:
-		socksVer = SOCKS4
-		destConn = s.handleSOCKS4(ctx, conn, preamble[1])
+		sess.version = SOCKS4
+		destConn = s.handleSOCKS4(ctx, sess, preamble[1])
 		if destConn == nil {
 			return
 		}
 	case SOCKS5:
-		socksVer = SOCKS5
-		destConn = s.handleSOCKS5(ctx, conn, preamble[1])
+		sess.version = SOCKS5
+		destConn = s.handleSOCKS5(ctx, sess, preamble[1])
 		if destConn == nil {
 			return
 		}
 	default:
-		fields := well.FieldsFromContext(ctx)
+		fields := fieldsFromContext(ctx)
 		fields["client_addr"] = conn.RemoteAddr().String()
+		span.SetStatus(codes.Error, "unknown SOCKS version")
 		_ = s.Logger.Error("unknown SOCKS version", fields)
-		connectionCounter.WithLabelValues(socksVer.LabelValue(), "unknown_version").Inc()
+		sess.fail(ResultInvalid, errors.New("unknown SOCKS version"))
+		connectionCounter.WithLabelValues(sess.version.LabelValue(), "unknown_version").Inc()
 		return
 	}
+	s.relay(ctx, sess, destConn)
+}
+
+// relay relays data between the client and destConn after
+// negotiation of sess completes.
+func (s *Server) relay(ctx context.Context, sess *session, destConn net.Conn) {
 	defer destConn.Close()
-	netutil.SetKeepAlive(destConn)
+	conn := sess.conn
+	r := sess.request
+	sess.destConn = destConn
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(requestAttributes(r)...)
+
+	si := newSessionInfo(r, destConn)
+	s.sessions.Store(si, struct{}{})
+	defer s.sessions.Delete(si)
 
 	// negotiation completed.
 	var zeroTime time.Time
 	_ = conn.SetDeadline(zeroTime)
 
+	clientConn := conn
+	if len(s.Middlewares) > 0 {
+		var err error
+		clientConn, destConn, err = s.wrapStreams(r, conn, destConn)
+		if err != nil {
+			fields := fieldsFromContext(ctx)
+			fields["client_addr"] = conn.RemoteAddr().String()
+			fields[log.FnError] = err.Error()
+			span.SetStatus(codes.Error, "stream middleware failed")
+			_ = s.Logger.Error("stream middleware failed", fields)
+			if errors.Is(err, ErrDenied) {
+				sess.fail(ResultDenied, err)
+			} else {
+				sess.fail(ResultError, err)
+			}
+			proxyRequestsInflightGauge.Sub(1)
+			return
+		}
+		defer clientConn.Close()
+		defer destConn.Close()
+	}
+
 	// do proxy
+	var tx, rx int64
 	st := time.Now()
-	env := well.NewEnvironment(ctx)
+	relayCtx, relaySpan := Tracer().Start(ctx, "socks.relay")
+	env := well.NewEnvironment(relayCtx)
 	env.Go(func(ctx context.Context) error {
 		sst := time.Now()
 		buf := s.pool.Get().([]byte)
-		b, err := io.CopyBuffer(destConn, conn, buf)
+		b, err := io.CopyBuffer(destConn, clientConn, buf)
+		tx = b
 		s.pool.Put(buf)
 		if hc, ok := destConn.(netutil.HalfCloser); ok {
 			_ = hc.CloseWrite()
 		}
-		if hc, ok := conn.(netutil.HalfCloser); ok {
+		if hc, ok := clientConn.(netutil.HalfCloser); ok {
 			_ = hc.CloseRead()
 		}
 		elapsed := time.Since(sst).Seconds()
@@ -193,9 +411,10 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	env.Go(func(ctx context.Context) error {
 		sst := time.Now()
 		buf := s.pool.Get().([]byte)
-		b, err := io.CopyBuffer(conn, destConn, buf)
+		b, err := io.CopyBuffer(clientConn, destConn, buf)
+		rx = b
 		s.pool.Put(buf)
-		if hc, ok := conn.(netutil.HalfCloser); ok {
+		if hc, ok := clientConn.(netutil.HalfCloser); ok {
 			_ = hc.CloseWrite()
 		}
 		if hc, ok := destConn.(netutil.HalfCloser); ok {
@@ -210,9 +429,22 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 		return err
 	})
 	env.Stop()
-	err = env.Wait()
+	err := env.Wait()
+	relaySpan.SetAttributes(
+		attribute.Int64("socks.tx_bytes", tx),
+		attribute.Int64("socks.rx_bytes", rx),
+	)
+	endSpan(relaySpan, err)
+	s.observeSession(sess, tx, rx)
+	sess.tx = tx
+	sess.rx = rx
+	if err != nil {
+		sess.fail(ResultError, err)
+	} else {
+		sess.result = ResultSuccess
+	}
 
-	fields := well.FieldsFromContext(ctx)
+	fields := fieldsFromContext(ctx)
 	elapsed := time.Since(st).Seconds()
 	fields["elapsed"] = elapsed
 	proxyRequestsInflightGauge.Sub(1)
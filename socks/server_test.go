@@ -1,14 +1,21 @@
 package socks
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cybozu-go/log"
 	"github.com/cybozu-go/well"
 )
 
@@ -353,3 +360,433 @@ func TestServerError(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestServerAccessLog(t *testing.T) {
+	t.Parallel()
+
+	_, err := exec.LookPath("curl")
+	if err != nil {
+		t.Skip("curl not found")
+	}
+
+	addr := "localhost:20088"
+	env := well.NewEnvironment(context.Background())
+	buf := new(bytes.Buffer)
+	accessLog := log.NewLogger()
+	accessLog.SetFormatter(log.JSONFormat{})
+	accessLog.SetOutput(buf)
+	s := &Server{
+		Rules:     rules{},
+		Env:       env,
+		AccessLog: accessLog,
+	}
+	ln, err := net.Listen("tcp", ":20088")
+	if err != nil {
+		t.Skip(err)
+	}
+	s.Serve(ln)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	hs := &http.Server{
+		Addr:    ":20089",
+		Handler: mux,
+	}
+	go func() {
+		_ = hs.ListenAndServe()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	url1 := "http://localhost:20089/ok"
+	curl := exec.Command("curl", "-4", "-I", "-U", "alice:", "--socks5-hostname", addr, url1)
+	out, err := curl.CombinedOutput()
+	if err != nil {
+		t.Error(err)
+		t.Log(string(out))
+	}
+
+	curl = exec.Command("curl", "-4", "-I", "--socks5", addr, url1)
+	err = curl.Run()
+	if err == nil {
+		t.Error("SOCKS5 w/o hostname should be denied")
+	}
+
+	env.Cancel(nil)
+	err = env.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 access logs, got %d: %v", len(records), records)
+	}
+	if records[0]["result"] != ResultSuccess || records[0]["user"] != "alice" || records[0]["dest_host"] != "localhost" {
+		t.Error("unexpected access log:", records[0])
+	}
+	if records[0]["rx_bytes"].(float64) == 0 {
+		t.Error("rx_bytes should be recorded:", records[0])
+	}
+	if records[1]["result"] != ResultDenied {
+		t.Error("unexpected access log:", records[1])
+	}
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []EventType
+	ends   []*Event
+}
+
+func (er *eventRecorder) HandleEvent(e *Event) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	er.events = append(er.events, e.Type)
+	if e.Type == EventSessionEnd {
+		er.ends = append(er.ends, e)
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	t.Parallel()
+
+	_, err := exec.LookPath("curl")
+	if err != nil {
+		t.Skip("curl not found")
+	}
+
+	addr := "localhost:20090"
+	env := well.NewEnvironment(context.Background())
+	er := &eventRecorder{}
+	s := &Server{
+		Rules:  rules{},
+		Env:    env,
+		Events: er,
+	}
+	ln, err := net.Listen("tcp", ":20090")
+	if err != nil {
+		t.Skip(err)
+	}
+	s.Serve(ln)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	hs := &http.Server{
+		Addr:    ":20091",
+		Handler: mux,
+	}
+	go func() {
+		_ = hs.ListenAndServe()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	url1 := "http://localhost:20091/ok"
+	curl := exec.Command("curl", "-4", "-I", "--socks5-hostname", addr, url1)
+	out, err := curl.CombinedOutput()
+	if err != nil {
+		t.Error(err)
+		t.Log(string(out))
+	}
+
+	env.Cancel(nil)
+	err = env.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	expected := []EventType{EventAuth, EventNegotiated, EventRule, EventDial, EventSessionEnd}
+	if len(er.events) != len(expected) {
+		t.Fatalf("unexpected events: %v", er.events)
+	}
+	for i, typ := range expected {
+		if er.events[i] != typ {
+			t.Errorf("event %d: expected %s, got %s", i, typ, er.events[i])
+		}
+	}
+	e := er.ends[0]
+	if e.Result != ResultSuccess || e.Request == nil || e.Request.Hostname != "localhost" {
+		t.Error("unexpected session end event:", e)
+	}
+	if e.RxBytes == 0 {
+		t.Error("rx bytes should be recorded:", e)
+	}
+}
+
+type countConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c countConn) CloseRead() error {
+	return c.Conn.(*net.TCPConn).CloseRead()
+}
+
+func (c countConn) CloseWrite() error {
+	return c.Conn.(*net.TCPConn).CloseWrite()
+}
+
+func TestServerMiddlewares(t *testing.T) {
+	t.Parallel()
+
+	_, err := exec.LookPath("curl")
+	if err != nil {
+		t.Skip("curl not found")
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var written int64
+	addr := "localhost:20092"
+	env := well.NewEnvironment(context.Background())
+	s := &Server{
+		Rules: rules{},
+		Env:   env,
+		Middlewares: []StreamMiddleware{
+			StreamMiddlewareFunc(func(r *Request, client, dest net.Conn) (net.Conn, net.Conn, error) {
+				mu.Lock()
+				order = append(order, "count")
+				mu.Unlock()
+				return client, countConn{dest, &written}, nil
+			}),
+			StreamMiddlewareFunc(func(r *Request, client, dest net.Conn) (net.Conn, net.Conn, error) {
+				mu.Lock()
+				order = append(order, "check")
+				mu.Unlock()
+				if _, ok := dest.(countConn); !ok {
+					return nil, nil, errors.New("dest is not wrapped")
+				}
+				return client, dest, nil
+			}),
+		},
+	}
+	ln, err := net.Listen("tcp", ":20092")
+	if err != nil {
+		t.Skip(err)
+	}
+	s.Serve(ln)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	hs := &http.Server{
+		Addr:    ":20093",
+		Handler: mux,
+	}
+	go func() {
+		_ = hs.ListenAndServe()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	url1 := "http://localhost:20093/ok"
+	curl := exec.Command("curl", "-4", "-I", "--socks5-hostname", addr, url1)
+	out, err := curl.CombinedOutput()
+	if err != nil {
+		t.Error(err)
+		t.Log(string(out))
+	}
+
+	env.Cancel(nil)
+	err = env.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "count" || order[1] != "check" {
+		t.Error("middlewares should be applied in order:", order)
+	}
+	if atomic.LoadInt64(&written) == 0 {
+		t.Error("bytes to the destination should be counted")
+	}
+}
+
+func TestServerTransparent(t *testing.T) {
+	t.Parallel()
+
+	env := well.NewEnvironment(context.Background())
+	er := &eventRecorder{}
+	s := &Server{
+		Rules:            rules{},
+		Env:              env,
+		Events:           er,
+		SniffTransparent: true,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:20094")
+	if err != nil {
+		t.Skip(err)
+	}
+	s.ServeTransparent(ln, func(conn net.Conn) (*net.TCPAddr, error) {
+		return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 20095}, nil
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	hs := &http.Server{
+		Addr:    "127.0.0.1:20095",
+		Handler: mux,
+	}
+	go func() {
+		_ = hs.ListenAndServe()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", "127.0.0.1:20094")
+			},
+		},
+	}
+	resp, err := client.Get("http://localhost:20095/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("unexpected status:", resp.StatusCode)
+	}
+	client.CloseIdleConnections()
+
+	// requests without server names are denied by rules.
+	conn, err := net.Dial("tcp", "127.0.0.1:20094")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("GET /ok HTTP/1.0\r\n\r\n"))
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); err == nil {
+		t.Error("request without server name should be denied")
+	}
+	conn.Close()
+
+	env.Cancel(nil)
+	err = env.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	if len(er.ends) != 2 {
+		t.Fatalf("unexpected session end events: %v", er.ends)
+	}
+	results := map[string]*Event{}
+	for _, e := range er.ends {
+		results[e.Result] = e
+	}
+	e := results[ResultSuccess]
+	if e == nil || e.Request.Version != Transparent || e.Request.Hostname != "localhost" || e.Request.Port != 20095 {
+		t.Error("unexpected session end event:", e)
+	}
+	if results[ResultDenied] == nil {
+		t.Error("denied session not found:", er.ends)
+	}
+}
+
+type testResolver struct{}
+
+func (testResolver) Resolve(r *Request) ([]net.IP, error) {
+	switch r.Hostname {
+	case "example.test":
+		return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}, nil
+	case "denied.test":
+		return nil, ErrDenied
+	}
+	return nil, errors.New("no such host")
+}
+
+func (testResolver) ResolvePTR(r *Request) ([]string, error) {
+	if r.IP.Equal(net.ParseIP("192.0.2.1")) {
+		return []string{"example.test."}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func socks5Resolve(t *testing.T, addr string, cmd commandType, req []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := append([]byte{5, 1, 0, 5, byte(cmd), 0}, req...)
+	msg = append(msg, 0, 0)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	var auth [2]byte
+	if _, err := io.ReadFull(conn, auth[:]); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestServerResolve(t *testing.T) {
+	t.Parallel()
+
+	env := well.NewEnvironment(context.Background())
+	s := &Server{
+		Env:      env,
+		Resolver: testResolver{},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:20096")
+	if err != nil {
+		t.Skip(err)
+	}
+	s.Serve(ln)
+
+	time.Sleep(10 * time.Millisecond)
+
+	domain := func(name string) []byte {
+		return append([]byte{byte(AddrDomain), byte(len(name))}, name...)
+	}
+	testCases := []struct {
+		cmd      commandType
+		req      []byte
+		expected []byte
+	}{
+		{CmdResolve, domain("example.test"), []byte{5, 0, 0, 1, 192, 0, 2, 1, 0, 0}},
+		{CmdResolve, domain("denied.test"), append([]byte{5, 2, 0}, append(domain("denied.test"), 0, 0)...)},
+		{CmdResolve, domain("unknown.test"), append([]byte{5, 4, 0}, append(domain("unknown.test"), 0, 0)...)},
+		{CmdResolve, []byte{byte(AddrIPv4), 192, 0, 2, 2}, []byte{5, 0, 0, 1, 192, 0, 2, 2, 0, 0}},
+		{CmdResolvePTR, []byte{byte(AddrIPv4), 192, 0, 2, 1}, append([]byte{5, 0, 0}, append(domain("example.test"), 0, 0)...)},
+		{CmdResolvePTR, domain("example.test"), []byte{5, 8, 0, 3}},
+	}
+	for _, tc := range testCases {
+		resp := socks5Resolve(t, "127.0.0.1:20096", tc.cmd, tc.req)
+		if !bytes.HasPrefix(resp, tc.expected) {
+			t.Errorf("%s %v: unexpected response: %v", tc.cmd, tc.req, resp)
+		}
+	}
+
+	env.Cancel(nil)
+	err = env.Wait()
+	if err != nil {
+		t.Error(err)
+	}
+}
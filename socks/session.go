@@ -0,0 +1,153 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"github.com/cybozu-go/well"
+)
+
+// Results of connections recorded in the access log.
+const (
+	ResultSuccess    = "success"
+	ResultError      = "error"
+	ResultInvalid    = "invalid_request"
+	ResultAuthFailed = "auth_failed"
+	ResultDenied     = "denied"
+	ResultDialFailed = "dial_failed"
+)
+
+// session holds the state of a connection from a client.
+type session struct {
+	conn     net.Conn
+	listener net.Addr
+	version  version
+	request  *Request
+	destConn net.Conn
+	startAt  time.Time
+	result   string
+	err      error
+	tx       int64
+	rx       int64
+}
+
+// fail records the first failure of the session.
+func (sess *session) fail(result string, err error) {
+	if len(sess.result) > 0 {
+		return
+	}
+	sess.result = result
+	sess.err = err
+}
+
+// endSession records the end of sess.
+func (s *Server) endSession(ctx context.Context, sess *session) {
+	s.logAccess(ctx, sess)
+	s.emit(&Event{
+		Type:       EventSessionEnd,
+		ClientAddr: sess.conn.RemoteAddr(),
+		Request:    sess.request,
+		Result:     sess.result,
+		TxBytes:    sess.tx,
+		RxBytes:    sess.rx,
+		Elapsed:    time.Since(sess.startAt),
+		Err:        sess.err,
+	})
+}
+
+// logAccess records an access log for sess.
+func (s *Server) logAccess(ctx context.Context, sess *session) {
+	if s.AccessLog == nil {
+		return
+	}
+
+	fields := fieldsFromContext(ctx)
+	fields[log.FnType] = logFieldType
+	fields["client_addr"] = sess.conn.RemoteAddr().String()
+	fields["result"] = sess.result
+	fields["elapsed"] = time.Since(sess.startAt).Seconds()
+	fields["tx_bytes"] = sess.tx
+	fields["rx_bytes"] = sess.rx
+	if sess.version != 0 {
+		fields[log.FnProtocol] = sess.version.String()
+	}
+	if sess.err != nil {
+		fields[log.FnError] = sess.err.Error()
+	}
+
+	if r := sess.request; r != nil {
+		for k, v := range r.logFields {
+			fields[k] = v
+		}
+		fields["command"] = r.Command.String()
+		if len(r.Hostname) > 0 {
+			fields["dest_host"] = r.Hostname
+		} else if r.IP != nil {
+			fields["dest_host"] = r.IP.String()
+		}
+		fields["dest_port"] = r.Port
+		if len(r.Username) > 0 {
+			fields["user"] = r.Username
+		}
+		if len(r.DenyReason) > 0 {
+			fields["deny_reason"] = r.DenyReason
+		}
+	}
+	if sess.destConn != nil {
+		fields["dest_addr"] = sess.destConn.RemoteAddr().String()
+		fields["src_addr"] = sess.destConn.LocalAddr().String()
+	}
+
+	_ = s.AccessLog.Info("access", fields)
+}
+
+// SessionInfo is a snapshot of an active proxy session.
+type SessionInfo struct {
+	ID         string    `json:"id,omitempty"`
+	Version    string    `json:"version"`
+	Command    string    `json:"command"`
+	Username   string    `json:"username,omitempty"`
+	ClientAddr string    `json:"client_addr"`
+	DestHost   string    `json:"dest_host"`
+	DestAddr   string    `json:"dest_addr"`
+	SrcAddr    string    `json:"src_addr"`
+	StartAt    time.Time `json:"start_at"`
+}
+
+func newSessionInfo(r *Request, destConn net.Conn) *SessionInfo {
+	si := &SessionInfo{
+		Version:    r.Version.String(),
+		Command:    r.Command.String(),
+		Username:   r.Username,
+		ClientAddr: r.Conn.RemoteAddr().String(),
+		DestAddr:   destConn.RemoteAddr().String(),
+		SrcAddr:    destConn.LocalAddr().String(),
+		StartAt:    time.Now(),
+	}
+	if id, ok := r.ctx.Value(well.RequestIDContextKey).(string); ok {
+		si.ID = id
+	}
+	if len(r.Hostname) > 0 {
+		si.DestHost = r.Hostname
+	} else {
+		si.DestHost = r.IP.String()
+	}
+	return si
+}
+
+// Sessions returns the list of active proxy sessions
+// in the order of their start time.
+func (s *Server) Sessions() []SessionInfo {
+	var sessions []SessionInfo
+	s.sessions.Range(func(key, value interface{}) bool {
+		sessions = append(sessions, *key.(*SessionInfo))
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartAt.Before(sessions[j].StartAt)
+	})
+	return sessions
+}
@@ -0,0 +1,274 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cybozu-go/netutil"
+)
+
+const (
+	maxSniffSize = 32 << 10
+
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	extensionServerName      = 0x0000
+	serverNameTypeHostName   = 0x00
+)
+
+var (
+	// ErrNoServerName is returned when the server name cannot be
+	// found in the data sent from the client.
+	ErrNoServerName = errors.New("no server name found")
+
+	errNeedMore = errors.New("need more data")
+)
+
+// ServerName extracts the server name from the first bytes sent by
+// a client.  It looks for the SNI extension of TLS ClientHello and
+// the Host header of HTTP/1.x requests.  The port number of the
+// Host header, if any, is removed.
+//
+// If b is too short to determine the name, io.ErrUnexpectedEOF is
+// returned.  If b is neither TLS nor HTTP or lacks the name,
+// ErrNoServerName is returned.
+func ServerName(b []byte) (string, error) {
+	var name string
+	var err error
+	if len(b) > 0 && b[0] == recordTypeHandshake {
+		name, err = tlsServerName(b)
+	} else {
+		name, err = httpHost(b)
+	}
+	if err == errNeedMore {
+		return "", io.ErrUnexpectedEOF
+	}
+	return name, err
+}
+
+// tlsServerName parses TLS records in b to find the SNI extension.
+func tlsServerName(b []byte) (string, error) {
+	// reassemble the handshake message from records.
+	var hs []byte
+	for {
+		if len(b) < 5 {
+			return "", errNeedMore
+		}
+		if b[0] != recordTypeHandshake {
+			return "", ErrNoServerName
+		}
+		l := int(b[3])<<8 | int(b[4])
+		if len(b) < 5+l {
+			return "", errNeedMore
+		}
+		hs = append(hs, b[5:5+l]...)
+		b = b[5+l:]
+
+		if len(hs) < 4 {
+			continue
+		}
+		if hs[0] != handshakeTypeClientHello {
+			return "", ErrNoServerName
+		}
+		hl := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+		if len(hs) >= 4+hl {
+			return clientHelloServerName(hs[4 : 4+hl])
+		}
+	}
+}
+
+// clientHelloServerName parses the body of ClientHello.
+func clientHelloServerName(b []byte) (string, error) {
+	// client_version + random
+	if len(b) < 34 {
+		return "", ErrNoServerName
+	}
+	b = b[34:]
+
+	// session_id, cipher_suites, and compression_methods
+	for _, lsize := range []int{1, 2, 1} {
+		_, rest, ok := readVector(b, lsize)
+		if !ok {
+			return "", ErrNoServerName
+		}
+		b = rest
+	}
+
+	exts, _, ok := readVector(b, 2)
+	if !ok {
+		return "", ErrNoServerName
+	}
+	for len(exts) >= 4 {
+		typ := int(exts[0])<<8 | int(exts[1])
+		data, rest, ok := readVector(exts[2:], 2)
+		if !ok {
+			return "", ErrNoServerName
+		}
+		exts = rest
+		if typ != extensionServerName {
+			continue
+		}
+
+		list, _, ok := readVector(data, 2)
+		if !ok {
+			return "", ErrNoServerName
+		}
+		for len(list) >= 1 {
+			nameType := list[0]
+			name, rest, ok := readVector(list[1:], 2)
+			if !ok {
+				return "", ErrNoServerName
+			}
+			list = rest
+			if nameType == serverNameTypeHostName && len(name) > 0 {
+				return strings.ToLower(string(name)), nil
+			}
+		}
+	}
+	return "", ErrNoServerName
+}
+
+// readVector reads a variable-length vector whose length is
+// encoded in lsize bytes.
+func readVector(b []byte, lsize int) (v, rest []byte, ok bool) {
+	if len(b) < lsize {
+		return nil, nil, false
+	}
+	l := 0
+	for i := 0; i < lsize; i++ {
+		l = l<<8 | int(b[i])
+	}
+	b = b[lsize:]
+	if len(b) < l {
+		return nil, nil, false
+	}
+	return b[:l], b[l:], true
+}
+
+// httpHost finds the Host header of an HTTP/1.x request in b.
+func httpHost(b []byte) (string, error) {
+	// request line: METHOD SP request-target SP HTTP-version CRLF
+	for i, c := range b {
+		if c == ' ' {
+			if i == 0 {
+				return "", ErrNoServerName
+			}
+			break
+		}
+		if c < 'A' || c > 'Z' {
+			return "", ErrNoServerName
+		}
+	}
+
+	idx := bytes.Index(b, []byte("\r\n"))
+	if idx == -1 {
+		return "", errNeedMore
+	}
+	if !bytes.Contains(b[:idx], []byte(" HTTP/1.")) {
+		return "", ErrNoServerName
+	}
+	b = b[idx+2:]
+
+	for {
+		idx := bytes.Index(b, []byte("\r\n"))
+		if idx == -1 {
+			return "", errNeedMore
+		}
+		if idx == 0 {
+			return "", ErrNoServerName
+		}
+		line := string(b[:idx])
+		b = b[idx+2:]
+
+		colon := strings.IndexByte(line, ':')
+		if colon == -1 || !strings.EqualFold(line[:colon], "host") {
+			continue
+		}
+		host := strings.TrimSpace(line[colon+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if len(host) == 0 {
+			return "", ErrNoServerName
+		}
+		return strings.ToLower(host), nil
+	}
+}
+
+// peekedConn is a net.Conn that replays peeked data before reading
+// from the underlying connection.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseRead() error {
+	if hc, ok := c.Conn.(netutil.HalfCloser); ok {
+		return hc.CloseRead()
+	}
+	return nil
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(netutil.HalfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// PeekServerName reads the first bytes sent from conn to find the
+// server name by ServerName.  It waits for data at most timeout.
+//
+// The returned net.Conn reads the peeked bytes first, then from conn.
+// It is returned even when err is not nil.  If the client sends no
+// data within timeout, ErrNoServerName is returned.
+func PeekServerName(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	buf := make([]byte, 0, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+	name := ""
+	err := io.ErrUnexpectedEOF
+	for err == io.ErrUnexpectedEOF {
+		if len(buf) == cap(buf) {
+			if len(buf) >= maxSniffSize {
+				err = ErrNoServerName
+				break
+			}
+			nbuf := make([]byte, len(buf), 2*cap(buf))
+			copy(nbuf, buf)
+			buf = nbuf
+		}
+
+		n, rerr := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if rerr != nil {
+			if ne, ok := rerr.(net.Error); ok && ne.Timeout() {
+				err = ErrNoServerName
+				break
+			}
+			if rerr == io.EOF {
+				err = ErrNoServerName
+				break
+			}
+			err = rerr
+			break
+		}
+		name, err = ServerName(buf)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	pc := &peekedConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(buf), conn),
+	}
+	return name, pc, err
+}
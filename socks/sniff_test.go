@@ -0,0 +1,139 @@
+package socks
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		tc := tls.Client(c1, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		_ = tc.Handshake()
+	}()
+
+	_ = c2.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var header [5]byte
+	if _, err := io.ReadFull(c2, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(c2, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header[:], body...)
+}
+
+func TestServerName(t *testing.T) {
+	t.Parallel()
+
+	hello := clientHello(t, "Www.Example.com")
+	name, err := ServerName(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.example.com" {
+		t.Error(`name != "www.example.com":`, name)
+	}
+
+	_, err = ServerName(hello[:len(hello)-1])
+	if err != io.ErrUnexpectedEOF {
+		t.Error("truncated ClientHello should need more data:", err)
+	}
+
+	// split the handshake message into two records.
+	body := hello[5:]
+	split := []byte{recordTypeHandshake, hello[1], hello[2], 0, 10}
+	split = append(split, body[:10]...)
+	split = append(split, recordTypeHandshake, hello[1], hello[2], byte((len(body)-10)>>8), byte(len(body)-10))
+	split = append(split, body[10:]...)
+	name, err = ServerName(split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.example.com" {
+		t.Error(`name != "www.example.com":`, name)
+	}
+
+	// IP addresses are not sent in SNI.
+	_, err = ServerName(clientHello(t, "192.168.0.1"))
+	if err != ErrNoServerName {
+		t.Error("ClientHello w/o SNI should have no server name:", err)
+	}
+
+	testCases := []struct {
+		data string
+		name string
+		err  error
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.org\r\n\r\n", "example.org", nil},
+		{"POST /a HTTP/1.0\r\nAccept: */*\r\nhost: Example.org:8080\r\n", "example.org", nil},
+		{"GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n", "::1", nil},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", "", ErrNoServerName},
+		{"GET / HTTP/1.1\r\nAccept: */*\r\n", "", io.ErrUnexpectedEOF},
+		{"GET / HT", "", io.ErrUnexpectedEOF},
+		{"", "", io.ErrUnexpectedEOF},
+		{"SSH-2.0-OpenSSH_9.0\r\n", "", ErrNoServerName},
+		{"\x00\x01\x02", "", ErrNoServerName},
+	}
+	for _, tc := range testCases {
+		name, err := ServerName([]byte(tc.data))
+		if err != tc.err {
+			t.Errorf("%q: unexpected error: %v", tc.data, err)
+			continue
+		}
+		if name != tc.name {
+			t.Errorf("%q: %q != %q", tc.data, name, tc.name)
+		}
+	}
+}
+
+func TestPeekServerName(t *testing.T) {
+	t.Parallel()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	req := "GET / HTTP/1.1\r\nHost: example.org\r\n\r\nbody"
+	go func() {
+		_, _ = c1.Write([]byte(req[:10]))
+		_, _ = c1.Write([]byte(req[10:]))
+		c1.Close()
+	}()
+
+	name, conn, err := PeekServerName(c2, 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "example.org" {
+		t.Error(`name != "example.org":`, name)
+	}
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != req {
+		t.Errorf("peeked data should be replayed: %q", data)
+	}
+
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	defer c4.Close()
+
+	_, _, err = PeekServerName(c4, 10*time.Millisecond)
+	if err != ErrNoServerName {
+		t.Error("silent client should have no server name:", err)
+	}
+}
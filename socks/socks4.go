@@ -3,17 +3,21 @@ package socks
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 
 	"github.com/cybozu-go/log"
-	"github.com/cybozu-go/well"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (s *Server) handleSOCKS4(ctx context.Context, conn net.Conn, cmdByte byte) net.Conn {
+func (s *Server) handleSOCKS4(ctx context.Context, sess *session, cmdByte byte) net.Conn {
+	conn := sess.conn
 	var responseData [8]byte
 	responseData[1] = byte(Status4Rejected)
-	fields := well.FieldsFromContext(ctx)
+	fields := fieldsFromContext(ctx)
 	fields[log.FnType] = logFieldType
 	fields[log.FnProtocol] = SOCKS4.String()
 	fields["client_addr"] = conn.RemoteAddr().String()
@@ -22,8 +26,12 @@ func (s *Server) handleSOCKS4(ctx context.Context, conn net.Conn, cmdByte byte)
 		_, _ = conn.Write(responseData[:])
 		if err != nil {
 			fields[log.FnError] = err.Error()
+		} else {
+			err = errors.New(msg)
 		}
+		sess.fail(ResultInvalid, err)
 		_ = s.Logger.Error(msg, fields)
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, msg)
 		status := socks4ResponseStatus(responseData[1])
 		connectionCounter.WithLabelValues(SOCKS4.LabelValue(), status.LabelValue()).Inc()
 		return nil
@@ -56,6 +64,7 @@ func (s *Server) handleSOCKS4(ctx context.Context, conn net.Conn, cmdByte byte)
 		Conn:     conn,
 		ctx:      ctx,
 	}
+	sess.request = r
 	if socks4a {
 		hostname, err := readUntilNull(conn)
 		if err != nil {
@@ -68,16 +77,48 @@ func (s *Server) handleSOCKS4(ctx context.Context, conn net.Conn, cmdByte byte)
 		fields["dest_host"] = r.IP.String()
 	}
 
-	if s.Auth != nil && !s.Auth.Authenticate(r) {
-		return errFunc("authentication failure", nil)
+	s.emit(&Event{
+		Type:       EventNegotiated,
+		ClientAddr: conn.RemoteAddr(),
+		Request:    r,
+	})
+
+	if s.Auth != nil {
+		_, span := Tracer().Start(ctx, "socks.auth")
+		ok := s.Auth.Authenticate(r)
+		span.SetAttributes(attribute.Bool("socks.authenticated", ok))
+		span.End()
+		s.emit(&Event{
+			Type:       EventAuth,
+			ClientAddr: conn.RemoteAddr(),
+			Request:    r,
+			OK:         ok,
+		})
+		if !ok {
+			sess.fail(ResultAuthFailed, errors.New("authentication failure"))
+			return errFunc("authentication failure", nil)
+		}
+	} else {
+		s.emit(&Event{
+			Type:       EventAuth,
+			ClientAddr: conn.RemoteAddr(),
+			Request:    r,
+			OK:         true,
+		})
 	}
 
-	if s.Rules != nil && !s.Rules.Match(r) {
+	if !s.matchRules(r) {
+		sess.fail(ResultDenied, errors.New("ruleset mismatch"))
 		return errFunc("ruleset mismatch", nil)
 	}
 
-	destConn, err := s.dial(ctx, r, "tcp4")
+	destConn, err := s.dial(r.ctx, r, "tcp4")
 	if err != nil {
+		if errors.Is(err, ErrDenied) {
+			sess.fail(ResultDenied, err)
+			return errFunc("denied by dialer", err)
+		}
+		sess.fail(ResultDialFailed, err)
 		return errFunc("dial to destination failed", err)
 	}
 
@@ -87,6 +128,7 @@ func (s *Server) handleSOCKS4(ctx context.Context, conn net.Conn, cmdByte byte)
 	_, err = conn.Write(responseData[:])
 	if err != nil {
 		destConn.Close()
+		sess.fail(ResultError, err)
 		return errFunc("failed to write response", err)
 	}
 
@@ -3,12 +3,15 @@ package socks
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 
 	"github.com/cybozu-go/log"
 	"github.com/cybozu-go/netutil"
-	"github.com/cybozu-go/well"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -19,20 +22,36 @@ const (
 	addressReadFailed = "failed"
 )
 
-func (s *Server) handleSOCKS5(ctx context.Context, conn net.Conn, nauth byte) net.Conn {
+func (s *Server) handleSOCKS5(ctx context.Context, sess *session, nauth byte) net.Conn {
+	conn := sess.conn
 	r := &Request{
 		Version: SOCKS5,
 		Conn:    conn,
 		ctx:     ctx,
 	}
-	if !s.negotiateAuth(r, int(nauth)) {
+	sess.request = r
+	ok := s.negotiateAuth(r, int(nauth))
+	s.emit(&Event{
+		Type:       EventAuth,
+		ClientAddr: conn.RemoteAddr(),
+		Request:    r,
+		OK:         ok,
+	})
+	if !ok {
+		sess.fail(ResultAuthFailed, errors.New("authentication failure"))
 		connectionCounter.WithLabelValues(SOCKS5.LabelValue(), "authentication_failure").Inc()
 		return nil
 	}
 	if !s.readAddress(r) {
+		sess.fail(ResultInvalid, errors.New("failed to read address"))
 		connectionCounter.WithLabelValues(SOCKS5.LabelValue(), "address_read_failure").Inc()
 		return nil
 	}
+	s.emit(&Event{
+		Type:       EventNegotiated,
+		ClientAddr: conn.RemoteAddr(),
+		Request:    r,
+	})
 
 	if s.Logger.Enabled(log.LvDebug) {
 		_ = s.Logger.Debug("request info", map[string]interface{}{
@@ -41,7 +60,7 @@ func (s *Server) handleSOCKS5(ctx context.Context, conn net.Conn, nauth byte) ne
 	}
 
 	response := makeSOCKS5Response(r)
-	fields := well.FieldsFromContext(ctx)
+	fields := fieldsFromContext(ctx)
 	fields[log.FnType] = logFieldType
 	fields[log.FnProtocol] = SOCKS5.String()
 	fields["client_addr"] = conn.RemoteAddr().String()
@@ -54,27 +73,49 @@ func (s *Server) handleSOCKS5(ctx context.Context, conn net.Conn, nauth byte) ne
 
 	errFunc := func(msg string) net.Conn {
 		_, _ = conn.Write(response)
+		sess.fail(ResultInvalid, errors.New(msg))
 		_ = s.Logger.Error(msg, fields)
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, msg)
 		status := socks5ResponseStatus(response[1])
 		connectionCounter.WithLabelValues(SOCKS5.LabelValue(), status.LabelValue()).Inc()
 		return nil
 	}
 
-	if r.Command != CmdConnect {
+	switch r.Command {
+	case CmdConnect, CmdResolve:
+	case CmdResolvePTR:
+		if r.IP == nil {
+			response[1] = byte(Status5AddressNotSupported)
+			return errFunc("address type not supported")
+		}
+	default:
 		response[1] = byte(Status5CommandNotSupported)
 		return errFunc("command not supported")
 	}
 
-	if s.Rules != nil {
-		if !s.Rules.Match(r) {
-			response[1] = byte(Status5DeniedByRuleset)
-			return errFunc("ruleset mismatch")
+	if !s.matchRules(r) {
+		response[1] = byte(Status5DeniedByRuleset)
+		sess.fail(ResultDenied, errors.New("ruleset mismatch"))
+		if r.Command != CmdConnect {
+			resolveCounter.WithLabelValues(r.Command.LabelValue(), resolveResultDenied).Inc()
 		}
+		return errFunc("ruleset mismatch")
+	}
+
+	if r.Command != CmdConnect {
+		s.resolve(ctx, sess, fields)
+		return nil
 	}
 
-	destConn, err := s.dial(ctx, r, "tcp")
+	destConn, err := s.dial(r.ctx, r, "tcp")
 	if err != nil {
 		fields[log.FnError] = err.Error()
+		if errors.Is(err, ErrDenied) {
+			response[1] = byte(Status5DeniedByRuleset)
+			sess.fail(ResultDenied, err)
+			return errFunc("denied by dialer")
+		}
+		sess.fail(ResultDialFailed, err)
 		switch {
 		case netutil.IsNetworkUnreachable(err):
 			response[1] = byte(Status5NetworkUnreachable)
@@ -91,6 +132,7 @@ func (s *Server) handleSOCKS5(ctx context.Context, conn net.Conn, nauth byte) ne
 	if err != nil {
 		destConn.Close()
 		fields[log.FnError] = err.Error()
+		sess.fail(ResultError, err)
 		return errFunc("failed to write response")
 	}
 
@@ -116,9 +158,14 @@ func hasAuth(t authType, methods []byte) bool {
 }
 
 func (s *Server) negotiateAuth(r *Request, nauth int) bool {
+	_, span := Tracer().Start(r.ctx, "socks.auth")
+	defer span.End()
+
 	var chosenAuthMethod authType
 	logError := func(msg string, err error) {
-		fields := well.FieldsFromContext(r.ctx)
+		span.SetAttributes(attribute.String("socks.auth_method", chosenAuthMethod.String()))
+		span.SetStatus(codes.Error, msg)
+		fields := fieldsFromContext(r.ctx)
 		fields[log.FnType] = logFieldType
 		fields[log.FnProtocol] = SOCKS5.String()
 		fields["client_addr"] = r.Conn.RemoteAddr().String()
@@ -208,6 +255,7 @@ func (s *Server) negotiateAuth(r *Request, nauth int) bool {
 			return false
 		}
 
+		span.SetAttributes(attribute.String("socks.auth_method", chosenAuthMethod.String()))
 		authNegotiateCounter.WithLabelValues(chosenAuthMethod.LabelValue(), authResultOk).Inc()
 		return true
 	}
@@ -226,6 +274,7 @@ func (s *Server) negotiateAuth(r *Request, nauth int) bool {
 			logError("failed to negotiate auth method", err)
 			return false
 		}
+		span.SetAttributes(attribute.String("socks.auth_method", chosenAuthMethod.String()))
 		authNegotiateCounter.WithLabelValues(chosenAuthMethod.LabelValue(), authResultOk).Inc()
 		return true
 	}
@@ -239,9 +288,13 @@ FAIL:
 }
 
 func (s *Server) readAddress(r *Request) bool {
+	_, span := Tracer().Start(r.ctx, "socks.read_address")
+	defer span.End()
+
 	var addrType addressType
 	logError := func(msg string, err error) {
-		fields := well.FieldsFromContext(r.ctx)
+		span.SetStatus(codes.Error, msg)
+		fields := fieldsFromContext(r.ctx)
 		fields[log.FnType] = logFieldType
 		fields[log.FnProtocol] = SOCKS5.String()
 		fields["client_addr"] = r.Conn.RemoteAddr().String()
@@ -313,6 +366,7 @@ func (s *Server) readAddress(r *Request) bool {
 	}
 	r.Port = int(binary.BigEndian.Uint16(portData[:]))
 
+	span.SetAttributes(requestAttributes(r)...)
 	addressReadCounter.WithLabelValues(addrType.LabelValue(), addressReadOk).Inc()
 	return true
 }
@@ -0,0 +1,63 @@
+package socks
+
+import (
+	"context"
+
+	"github.com/cybozu-go/well"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/cybozu-go/usocksd/socks"
+
+	// FnTraceID is the log field name for the trace ID.
+	FnTraceID = "trace_id"
+)
+
+// Tracer returns the tracer for spans of proxy sessions.
+// Dialer implementations can use this to add spans for DNS
+// lookups and connection attempts.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// fieldsFromContext returns log fields for ctx.
+// In addition to fields from well.FieldsFromContext, the trace ID
+// is included if ctx has a valid span.
+func fieldsFromContext(ctx context.Context) map[string]interface{} {
+	fields := well.FieldsFromContext(ctx)
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		fields[FnTraceID] = sc.TraceID().String()
+	}
+	return fields
+}
+
+// requestAttributes returns span attributes describing r.
+func requestAttributes(r *Request) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("socks.version", r.Version.String()),
+		attribute.String("socks.command", r.Command.String()),
+		attribute.Int("destination.port", r.Port),
+	}
+	if len(r.Hostname) > 0 {
+		attrs = append(attrs, attribute.String("destination.host", r.Hostname))
+	} else {
+		attrs = append(attrs, attribute.String("destination.host", r.IP.String()))
+	}
+	if len(r.Username) > 0 {
+		attrs = append(attrs, attribute.String("socks.user", r.Username))
+	}
+	return attrs
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
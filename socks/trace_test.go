@@ -0,0 +1,31 @@
+package socks
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestFieldsFromContext(t *testing.T) {
+	t.Parallel()
+
+	fields := fieldsFromContext(context.Background())
+	if _, ok := fields[FnTraceID]; ok {
+		t.Error("trace_id should not be set without a span")
+	}
+
+	traceID, err := trace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	fields = fieldsFromContext(ctx)
+	if fields[FnTraceID] != "0102030405060708090a0b0c0d0e0f10" {
+		t.Error("unexpected trace_id:", fields[FnTraceID])
+	}
+}
@@ -0,0 +1,180 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cybozu-go/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	transparentSniffTimeout = 3 * time.Second
+
+	// labels of connectionCounter for transparent connections.
+	transparentGranted       = "granted"
+	transparentInvalid       = "invalid_request"
+	transparentAuthFailure   = "authentication_failure"
+	transparentDenied        = "not_allowed"
+	transparentDialFailure   = "dial_failure"
+	transparentNotRedirected = "not_redirected"
+)
+
+// ErrNotRedirected is returned by OriginalDestination when a
+// connection was not intercepted but made to the listener directly.
+var ErrNotRedirected = errors.New("connection is not redirected")
+
+// OriginalDestination returns the address that a client connected to
+// before the connection was intercepted by a transparent proxy.
+type OriginalDestination func(conn net.Conn) (*net.TCPAddr, error)
+
+// ServeTransparent starts a goroutine to accept connections intercepted
+// by a transparent proxy such as Linux iptables REDIRECT or TPROXY.
+// This returns immediately.  l will be closed when s.Env is canceled.
+//
+// Each connection is handled as a CONNECT request to the address
+// returned by dest.  The request, whose Version is Transparent, is
+// tested by Auth and Rules, connected by Dialer, and logged in the
+// same way as SOCKS requests.
+func (s *Server) ServeTransparent(l net.Listener, dest OriginalDestination) {
+	s.once.Do(s.init)
+	s.serve(l, func(ctx context.Context, conn net.Conn, listener net.Addr) {
+		s.handleTransparent(ctx, conn, listener, dest)
+	})
+}
+
+// handleTransparent proxies a connection intercepted by a transparent proxy.
+func (s *Server) handleTransparent(ctx context.Context, conn net.Conn, listener net.Addr, dest OriginalDestination) {
+	ctx, span := Tracer().Start(ctx, "socks.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("client.address", conn.RemoteAddr().String())),
+	)
+	defer span.End()
+
+	_ = conn.SetDeadline(time.Now().Add(s.NegotiationTimeout))
+
+	sess := &session{
+		conn:     conn,
+		listener: listener,
+		version:  Transparent,
+		startAt:  time.Now(),
+	}
+	defer s.endSession(ctx, sess)
+
+	destConn := s.negotiateTransparent(ctx, sess, dest)
+	if destConn == nil {
+		return
+	}
+	s.relay(ctx, sess, destConn)
+}
+
+// negotiateTransparent makes a request from the original destination
+// and connects to it.
+func (s *Server) negotiateTransparent(ctx context.Context, sess *session, dest OriginalDestination) net.Conn {
+	conn := sess.conn
+	fields := fieldsFromContext(ctx)
+	fields[log.FnType] = logFieldType
+	fields[log.FnProtocol] = Transparent.String()
+	fields["client_addr"] = conn.RemoteAddr().String()
+	fields["command"] = CmdConnect.String()
+
+	errFunc := func(msg, status string, err error) net.Conn {
+		if err != nil {
+			fields[log.FnError] = err.Error()
+		} else {
+			err = errors.New(msg)
+		}
+		sess.fail(ResultInvalid, err)
+		_ = s.Logger.Error(msg, fields)
+		trace.SpanFromContext(ctx).SetStatus(codes.Error, msg)
+		connectionCounter.WithLabelValues(Transparent.LabelValue(), status).Inc()
+		return nil
+	}
+
+	addr, err := dest(conn)
+	if err != nil {
+		if errors.Is(err, ErrNotRedirected) {
+			return errFunc("connection is not redirected", transparentNotRedirected, err)
+		}
+		return errFunc("failed to get original destination", transparentInvalid, err)
+	}
+
+	r := &Request{
+		Version: Transparent,
+		Command: CmdConnect,
+		IP:      addr.IP,
+		Port:    addr.Port,
+		Conn:    conn,
+		ctx:     ctx,
+	}
+	sess.request = r
+	fields["dest_host"] = addr.IP.String()
+
+	if s.SniffTransparent {
+		name, pc, err := PeekServerName(conn, transparentSniffTimeout)
+		sess.conn = pc
+		r.Conn = pc
+		switch err {
+		case nil:
+			r.Hostname = name
+			fields["dest_host"] = name
+		case ErrNoServerName:
+		default:
+			return errFunc("failed to read server name", transparentInvalid, err)
+		}
+	}
+
+	s.emit(&Event{
+		Type:       EventNegotiated,
+		ClientAddr: conn.RemoteAddr(),
+		Request:    r,
+	})
+
+	ok := true
+	if s.Auth != nil {
+		_, span := Tracer().Start(ctx, "socks.auth")
+		ok = s.Auth.Authenticate(r)
+		span.SetAttributes(attribute.Bool("socks.authenticated", ok))
+		span.End()
+	}
+	s.emit(&Event{
+		Type:       EventAuth,
+		ClientAddr: conn.RemoteAddr(),
+		Request:    r,
+		OK:         ok,
+	})
+	if !ok {
+		sess.fail(ResultAuthFailed, errors.New("authentication failure"))
+		return errFunc("authentication failure", transparentAuthFailure, nil)
+	}
+
+	if !s.matchRules(r) {
+		sess.fail(ResultDenied, errors.New("ruleset mismatch"))
+		return errFunc("ruleset mismatch", transparentDenied, nil)
+	}
+
+	destConn, err := s.dial(r.ctx, r, "tcp")
+	if err != nil {
+		if errors.Is(err, ErrDenied) {
+			sess.fail(ResultDenied, err)
+			return errFunc("denied by dialer", transparentDenied, err)
+		}
+		sess.fail(ResultDialFailed, err)
+		return errFunc("dial to destination failed", transparentDialFailure, err)
+	}
+
+	fields["dest_addr"] = destConn.RemoteAddr().String()
+	fields["src_addr"] = destConn.LocalAddr().String()
+	connectionCounter.WithLabelValues(Transparent.LabelValue(), transparentGranted).Inc()
+	proxyRequestsInflightGauge.Add(1)
+	if s.SilenceLogs {
+		_ = s.Logger.Debug("proxy starts", fields)
+	} else {
+		_ = s.Logger.Info("proxy starts", fields)
+	}
+	return destConn
+}
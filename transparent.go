@@ -0,0 +1,239 @@
+package usocksd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cybozu-go/usocksd/socks"
+	"golang.org/x/sys/unix"
+)
+
+// Modes of transparent proxy.
+const (
+	TransparentModeRedirect = "redirect"
+	TransparentModeTProxy   = "tproxy"
+)
+
+// ip6tSOOriginalDst is IP6T_SO_ORIGINAL_DST of ip6tables.
+const ip6tSOOriginalDst = 80
+
+// TransparentConfig is a set of configurations to accept connections
+// intercepted by iptables REDIRECT or TPROXY target.
+//
+// Port is the port number of the listeners.  Zero disables transparent
+// proxy.  Mode is either "redirect" (default) or "tproxy".  Listening
+// in tproxy mode requires CAP_NET_ADMIN.  If Sniff is true, the server
+// name in TLS SNI or HTTP Host header is used as the destination
+// hostname.
+type TransparentConfig struct {
+	Port      int
+	Addresses []net.IP
+	Mode      string
+	Sniff     bool
+}
+
+func (tc *TransparentConfig) validate(c *Config) error {
+	if tc.Port == 0 {
+		return nil
+	}
+	if tc.Port < 0 || tc.Port > 65535 {
+		return fmt.Errorf("transparent: invalid port: %d", tc.Port)
+	}
+	if tc.Port == c.Incoming.Port || tc.Port == c.Incoming.MetricsPort {
+		return fmt.Errorf("transparent: port %d is already used", tc.Port)
+	}
+	switch tc.Mode {
+	case "", TransparentModeRedirect, TransparentModeTProxy:
+	default:
+		return errors.New("transparent: unknown mode: " + tc.Mode)
+	}
+	return nil
+}
+
+// transparentListeners returns listeners for transparent proxy.
+func transparentListeners(c *Config) ([]net.Listener, error) {
+	tc := &c.Transparent
+	if tc.Port == 0 {
+		return nil, nil
+	}
+
+	lc := c.Incoming.Socket.listenConfig()
+	if tc.Mode == TransparentModeTProxy {
+		lc.Control = chainControl(lc.Control, transparentControl)
+	}
+	addrs := []string{":" + strconv.Itoa(tc.Port)}
+	if len(tc.Addresses) > 0 {
+		addrs = addrs[:0]
+		for _, a := range tc.Addresses {
+			addrs = append(addrs, net.JoinHostPort(a.String(), strconv.Itoa(tc.Port)))
+		}
+	}
+
+	lns := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, fmt.Errorf("transparent: %w", err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// transparentControl sets IP_TRANSPARENT or IPV6_TRANSPARENT so that
+// the listener accepts connections to non-local addresses.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return rawControl(c, func(fd int) error {
+		if network == "tcp4" {
+			return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+		// this also applies to IPv4 connections to dual-stack sockets.
+		return unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	})
+}
+
+// SplitListeners splits lns returned by Listeners into listeners for
+// SOCKS and those for transparent proxy.
+func SplitListeners(c *Config, lns []net.Listener) (socksLns, transparentLns []net.Listener) {
+	for _, ln := range lns {
+		if c.Transparent.Port != 0 && listenerPort(ln) == c.Transparent.Port {
+			transparentLns = append(transparentLns, ln)
+		} else {
+			socksLns = append(socksLns, ln)
+		}
+	}
+	return
+}
+
+func listenerPort(ln net.Listener) int {
+	if a, ok := ln.Addr().(*net.TCPAddr); ok {
+		return a.Port
+	}
+	return 0
+}
+
+// OriginalDestination returns a function to find the original
+// destination of connections by the transparent proxy mode of c.
+func OriginalDestination(c *Config) socks.OriginalDestination {
+	if c.Transparent.Mode == TransparentModeTProxy {
+		port := c.Transparent.Port
+		return func(conn net.Conn) (*net.TCPAddr, error) {
+			return tproxyDestination(conn, port)
+		}
+	}
+	return redirectDestination
+}
+
+// tproxyDestination returns the local address of conn, which is the
+// original destination with TPROXY.
+func tproxyDestination(conn net.Conn, port int) (*net.TCPAddr, error) {
+	la, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	if la.Port == port && isLocalIP(la.IP) {
+		return nil, socks.ErrNotRedirected
+	}
+	return la, nil
+}
+
+// localAddrsTTL is how long addresses of interfaces are cached.
+const localAddrsTTL = 10 * time.Second
+
+// localAddrs caches addresses of interfaces, as net.InterfaceAddrs
+// dumps them via netlink every time.
+var localAddrs struct {
+	mu     sync.Mutex
+	addrs  map[string]bool
+	expire time.Time
+}
+
+// isLocalIP returns true if ip is assigned to an interface of this host.
+func isLocalIP(ip net.IP) bool {
+	localAddrs.mu.Lock()
+	defer localAddrs.mu.Unlock()
+
+	if now := time.Now(); now.After(localAddrs.expire) {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return false
+		}
+		m := make(map[string]bool, len(addrs))
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				m[n.IP.String()] = true
+			}
+		}
+		localAddrs.addrs = m
+		localAddrs.expire = now.Add(localAddrsTTL)
+	}
+	return localAddrs.addrs[ip.String()]
+}
+
+// redirectDestination reads the original destination of conn
+// redirected by iptables REDIRECT from SO_ORIGINAL_DST.
+func redirectDestination(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	la, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	err = rawControl(raw, func(fd int) error {
+		if la.IP.To4() != nil {
+			// sockaddr_in fits in struct ipv6_mreq.
+			mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				return err
+			}
+			sa := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+				Port: int(binary.BigEndian.Uint16(sa[2:4])),
+			}
+			return nil
+		}
+		// sockaddr_in6 fits in struct ip6_mtuinfo.
+		info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, ip6tSOOriginalDst)
+		if err != nil {
+			return err
+		}
+		sa := info.Addr
+		// sin6_port is in network byte order.
+		var port [2]byte
+		binary.NativeEndian.PutUint16(port[:], sa.Port)
+		addr = &net.TCPAddr{
+			IP:   net.IP(sa.Addr[:]),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+		return nil
+	})
+	if errors.Is(err, unix.ENOENT) {
+		return nil, socks.ErrNotRedirected
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SO_ORIGINAL_DST: %w", err)
+	}
+	if addr.IP.Equal(la.IP) && addr.Port == la.Port {
+		return nil, socks.ErrNotRedirected
+	}
+	return addr, nil
+}
@@ -0,0 +1,98 @@
+package usocksd
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cybozu-go/usocksd/socks"
+)
+
+func TestTransparentConfig(t *testing.T) {
+	t.Parallel()
+
+	c := NewConfig()
+	c.Transparent.Port = 12345
+	if err := c.Transparent.validate(c); err != nil {
+		t.Error(err)
+	}
+	c.Transparent.Mode = "nat"
+	if err := c.Transparent.validate(c); err == nil {
+		t.Error("unknown mode should fail")
+	}
+	c.Transparent.Mode = TransparentModeTProxy
+	c.Transparent.Port = c.Incoming.Port
+	if err := c.Transparent.validate(c); err == nil {
+		t.Error("port of SOCKS should fail")
+	}
+}
+
+func TestSplitListeners(t *testing.T) {
+	t.Parallel()
+
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+
+	c := NewConfig()
+	c.Transparent.Port = l2.Addr().(*net.TCPAddr).Port
+	socksLns, transparentLns := SplitListeners(c, []net.Listener{l1, l2})
+	if len(socksLns) != 1 || socksLns[0] != l1 {
+		t.Error("unexpected SOCKS listeners:", socksLns)
+	}
+	if len(transparentLns) != 1 || transparentLns[0] != l2 {
+		t.Error("unexpected transparent listeners:", transparentLns)
+	}
+}
+
+func TestOriginalDestination(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			var buf [1]byte
+			_, _ = conn.Read(buf[:])
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// direct connections are not redirected.
+	c := NewConfig()
+	c.Transparent.Port = port
+	if _, err := OriginalDestination(c)(conn); !errors.Is(err, socks.ErrNotRedirected) {
+		t.Error("redirect: direct connection should be detected:", err)
+	}
+	c.Transparent.Mode = TransparentModeTProxy
+	if _, err := OriginalDestination(c)(conn); !errors.Is(err, socks.ErrNotRedirected) {
+		t.Error("tproxy: direct connection should be detected:", err)
+	}
+
+	// with TPROXY, the local address is the original destination.
+	c.Transparent.Port = port + 1
+	addr, err := OriginalDestination(c)(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.Port != port || !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Error("unexpected original destination:", addr)
+	}
+}